@@ -18,6 +18,7 @@ import (
 
 	nkn "github.com/nknorg/nkn-sdk-go"
 	"github.com/rule110-io/surge/backend/platform"
+	"github.com/rule110-io/surge/backend/sessionmanager"
 )
 
 const accountPath = "account.surge"
@@ -73,3 +74,11 @@ func GetAccountAddress() string {
 	}
 	return client.Addr().String()
 }
+
+//GetSessionAddress returns the address peers open sessions with us on, the account address unless another session transport is configured
+func GetSessionAddress() string {
+	for !clientInitialized {
+		time.Sleep(time.Millisecond * 50)
+	}
+	return sessionmanager.GetLocalAddress()
+}
@@ -0,0 +1,275 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rule110-io/surge/backend/events"
+)
+
+//maximum number of events buffered per websocket client before events are dropped
+const eventBufferSize = 256
+
+// Server exposes the middleware functions as a token authenticated json api.
+// Every allowed method is reachable at /api/<Method>, positional arguments are posted as a json array.
+// Backend events are streamed to websocket clients connected to /api/events.
+// Browsers may only call the api from pages served on its own address.
+type Server struct {
+	token   string
+	target  reflect.Value
+	methods map[string]bool
+	addr    string
+
+	upgrader    websocket.Upgrader
+	clients     map[*websocket.Conn]chan []byte
+	clientsLock sync.Mutex
+}
+
+//Event is the json frame sent to websocket clients for every backend event
+type Event struct {
+	Event string
+	Data  []interface{}
+	Time  int64
+}
+
+type callResponse struct {
+	Result interface{}
+	Error  string `json:",omitempty"`
+}
+
+//NewServer creates an api server calling the given methods on target, requests must carry the given token
+func NewServer(token string, target interface{}, methods []string) *Server {
+	s := &Server{
+		token:   token,
+		target:  reflect.ValueOf(target),
+		methods: make(map[string]bool),
+		clients: make(map[*websocket.Conn]chan []byte),
+	}
+	for _, method := range methods {
+		s.methods[method] = true
+	}
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: s.checkOrigin,
+	}
+	return s
+}
+
+//ListenAndServe serves the api on the given address, this blocks until the listener fails
+func (s *Server) ListenAndServe(addr string) error {
+	s.addr = addr
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/events", s.authenticate(s.handleEvents))
+	mux.HandleFunc("/api/methods", s.authenticate(s.handleMethods))
+	mux.HandleFunc("/api/", s.authenticate(s.handleCall))
+
+	log.Println("Control api listening on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+//Emit sends an event to all connected websocket clients, it is an events.Handler
+func (s *Server) Emit(event events.Event) {
+	frame, err := json.Marshal(Event{
+		Event: string(event.Name),
+		Data:  event.Data,
+		Time:  event.Time,
+	})
+	if err != nil {
+		log.Println("Control api event marshal:", err)
+		return
+	}
+
+	s.clientsLock.Lock()
+	defer s.clientsLock.Unlock()
+
+	for _, send := range s.clients {
+		//Slow clients miss events rather than blocking the backend
+		select {
+		case send <- frame:
+		default:
+		}
+	}
+}
+
+// returns whether a request comes from outside a browser or from a page served on the api address
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+
+	originURL, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(originURL.Host, s.addr)
+}
+
+// checks the origin and the token from the authorization header, or the token query param for websocket clients
+func (s *Server) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkOrigin(r) {
+			writeJSON(w, http.StatusForbidden, callResponse{Error: "origin not allowed"})
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if len(token) == 0 {
+			token = r.URL.Query().Get("token")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, callResponse{Error: "invalid api token"})
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// lists all callable methods with their argument types
+func (s *Server) handleMethods(w http.ResponseWriter, r *http.Request) {
+	methods := make(map[string][]string)
+
+	targetType := s.target.Type()
+	for i := 0; i < targetType.NumMethod(); i++ {
+		method := targetType.Method(i)
+		if !s.methods[method.Name] {
+			continue
+		}
+
+		args := []string{}
+		//skip the receiver
+		for j := 1; j < method.Type.NumIn(); j++ {
+			args = append(args, method.Type.In(j).String())
+		}
+		methods[method.Name] = args
+	}
+
+	writeJSON(w, http.StatusOK, callResponse{Result: methods})
+}
+
+// calls the method named in the path with the json array of arguments in the body
+func (s *Server) handleCall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, callResponse{Error: "use GET or POST"})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/")
+	method := s.target.MethodByName(name)
+	if len(name) == 0 || !s.methods[name] || !method.IsValid() {
+		writeJSON(w, http.StatusNotFound, callResponse{Error: "unknown method " + name})
+		return
+	}
+
+	rawArgs := []json.RawMessage{}
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, callResponse{Error: err.Error()})
+			return
+		}
+		if len(strings.TrimSpace(string(body))) > 0 {
+			err = json.Unmarshal(body, &rawArgs)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, callResponse{Error: "arguments must be a json array: " + err.Error()})
+				return
+			}
+		}
+	}
+
+	args, err := decodeArgs(method.Type(), rawArgs)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, callResponse{Error: err.Error()})
+		return
+	}
+
+	results := method.Call(args)
+
+	var result interface{}
+	if len(results) > 0 {
+		result = results[0].Interface()
+	}
+	writeJSON(w, http.StatusOK, callResponse{Result: result})
+}
+
+// upgrades to a websocket and streams events until the client disconnects
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Control api websocket upgrade:", err)
+		return
+	}
+
+	send := make(chan []byte, eventBufferSize)
+
+	s.clientsLock.Lock()
+	s.clients[conn] = send
+	s.clientsLock.Unlock()
+
+	removeClient := func() {
+		s.clientsLock.Lock()
+		delete(s.clients, conn)
+		s.clientsLock.Unlock()
+		conn.Close()
+	}
+	defer removeClient()
+
+	//We do not expect messages from clients, reading detects the disconnect
+	closed := make(chan struct{})
+	readPump := func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}
+	go readPump()
+
+	for {
+		select {
+		case frame := <-send:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// decodes positional json arguments into the parameter types of a method
+func decodeArgs(methodType reflect.Type, rawArgs []json.RawMessage) ([]reflect.Value, error) {
+	if len(rawArgs) != methodType.NumIn() {
+		params := []string{}
+		for i := 0; i < methodType.NumIn(); i++ {
+			params = append(params, methodType.In(i).String())
+		}
+		return nil, errors.New("expected arguments [" + strings.Join(params, ", ") + "]")
+	}
+
+	args := make([]reflect.Value, len(rawArgs))
+	for i, raw := range rawArgs {
+		arg := reflect.New(methodType.In(i))
+		if err := json.Unmarshal(raw, arg.Interface()); err != nil {
+			return nil, errors.New("invalid argument " + methodType.In(i).String() + ": " + err.Error())
+		}
+		args[i] = arg.Elem()
+	}
+	return args, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, response callResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
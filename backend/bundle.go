@@ -0,0 +1,540 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the directory bundles
+	A seeded directory is listed as a single bundle, its manifest lists the relative path, size and hash of every file.
+	Downloaders fetch the manifest from a seeder, verify it against the bundle hash and download the files they pick.
+*/
+
+package surge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/models"
+	pb "github.com/rule110-io/surge/backend/payloads"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+	"google.golang.org/protobuf/proto"
+)
+
+//Manifest json of remote bundles by bundle hash, verified against the hash on arrival
+var bundleManifestMap map[string][]byte
+var bundleManifestLock = sync.Mutex{}
+
+//SeedDirectory hashes every file in a directory and seeds them as a single bundle
+func SeedDirectory(Path string, Topic string) bool {
+	permissions := GetTopicPermissions(Topic, GetAccountAddress())
+	if !permissions.CanWrite {
+		pushError("Seed Directory Error", "no write permission for this topic.")
+		return false
+	}
+
+	info, err := os.Stat(Path)
+	if err != nil || !info.IsDir() {
+		pushError("Seed Directory Error", "no directory found at "+Path)
+		return false
+	}
+
+	log.Println("Seeding directory", Path)
+	go seedDirectory(Path, Topic)
+
+	return true
+}
+
+func seedDirectory(root string, topic string) {
+	defer RecoverAndLog()
+
+	name := filepath.Base(root)
+	pushNotification("Hashing directory", name)
+
+	manifest := models.BundleManifest{
+		Name:  name,
+		Files: []models.BundleFile{},
+	}
+	paths := map[string]string{}
+
+	//WalkDir visits files in lexical order so the manifest, and thereby its hash, is stable
+	err := filepath.WalkDir(root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		//Empty files have no chunks to transfer
+		if info.Size() == 0 {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+
+		fileHash, chunkHashes, err := HashFileChunks(filePath)
+		if err != nil {
+			return err
+		}
+		setChunkHashes(fileHash, chunkHashes)
+
+		manifest.Files = append(manifest.Files, models.BundleFile{
+			Path:     filepath.ToSlash(relativePath),
+			FileSize: info.Size(),
+			FileHash: fileHash,
+		})
+		paths[fileHash] = filePath
+		return nil
+	})
+	if err != nil {
+		pushError("Seed Directory Error", "could not hash directory "+root+": "+err.Error())
+		return
+	}
+	if len(manifest.Files) == 0 {
+		pushError("Seed Directory Error", name+" contains no files to seed.")
+		return
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		pushError("Seed Directory Error", err.Error())
+		return
+	}
+	bundleHash := hashBundleManifest(manifestBytes)
+
+	//Check if directory is already seeded
+	_, err = dbGetBundle(bundleHash)
+	if err == nil {
+		pushError("Seed Directory Error", name+" already seeding.")
+		return
+	}
+
+	bundle := models.Bundle{
+		BundleHash: bundleHash,
+		Topic:      topic,
+		Manifest:   manifestBytes,
+	}
+	dbInsertBundle(bundle)
+
+	for _, bundleFile := range manifest.Files {
+		//Files with the same content are stored once
+		_, err := dbGetFile(bundleFile.FileHash)
+		if err == nil {
+			continue
+		}
+
+		numChunks := int((bundleFile.FileSize-1)/int64(constants.ChunkSize)) + 1
+		chunkMap := bitmap.NewSlice(numChunks)
+
+		//Local files are always fully available, set all chunks to 1
+		for i := 0; i < numChunks; i++ {
+			bitmap.Set(chunkMap, i, true)
+		}
+
+		dbInsertFile(models.File{
+			FileName:    name + "/" + bundleFile.Path,
+			FileSize:    bundleFile.FileSize,
+			FileHash:    bundleFile.FileHash,
+			Path:        paths[bundleFile.FileHash],
+			NumChunks:   numChunks,
+			ChunkMap:    chunkMap,
+			IsUploading: true,
+			Topic:       topic,
+			BundleHash:  bundleHash,
+		})
+	}
+
+	AnnounceNewBundle(&bundle, &manifest)
+
+	pushNotification("Now seeding", name)
+	emitFileEvent(events.FileSeeded, &models.File{
+		FileName: name,
+		FileSize: bundleSize(&manifest),
+		FileHash: bundleHash,
+		Path:     root,
+		Topic:    topic,
+	}, "")
+}
+
+// returns the hash identifying a bundle, the hex sha256 of its manifest
+func hashBundleManifest(manifest []byte) string {
+	hash := sha256.Sum256(manifest)
+	return hex.EncodeToString(hash[:])
+}
+
+func parseBundleManifest(manifest []byte) (*models.BundleManifest, error) {
+	result := &models.BundleManifest{}
+	err := json.Unmarshal(manifest, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// returns the total size of the files in a bundle
+func bundleSize(manifest *models.BundleManifest) int64 {
+	size := int64(0)
+	for _, bundleFile := range manifest.Files {
+		size += bundleFile.FileSize
+	}
+	return size
+}
+
+// returns whether we seed every file of a bundle
+func isBundleSeeding(manifest *models.BundleManifest) bool {
+	for _, bundleFile := range manifest.Files {
+		dbFile, err := dbGetFile(bundleFile.FileHash)
+		if err != nil || !dbFile.IsUploading {
+			return false
+		}
+	}
+	return true
+}
+
+// validates a relative manifest path so files can not be written outside the bundle folder
+func isValidBundlePath(bundlePath string) bool {
+	if len(bundlePath) == 0 || strings.Contains(bundlePath, "\\") || path.IsAbs(bundlePath) {
+		return false
+	}
+	return path.Clean(bundlePath) == bundlePath && bundlePath != "." && !strings.HasPrefix(bundlePath, "../") && bundlePath != ".."
+}
+
+// returns the manifest json of a bundle, local bundles are read from the db
+func getBundleManifestBytes(bundleHash string) []byte {
+	bundleManifestLock.Lock()
+	manifestBytes, exists := bundleManifestMap[bundleHash]
+	bundleManifestLock.Unlock()
+	if exists {
+		return manifestBytes
+	}
+
+	bundle, err := dbGetBundle(bundleHash)
+	if err != nil {
+		return nil
+	}
+	return bundle.Manifest
+}
+
+// returns the manifest of a bundle, nil when we do not know it
+func getBundleManifest(bundleHash string) *models.BundleManifest {
+	manifestBytes := getBundleManifestBytes(bundleHash)
+	if manifestBytes == nil {
+		return nil
+	}
+
+	manifest, err := parseBundleManifest(manifestBytes)
+	if err != nil {
+		return nil
+	}
+	return manifest
+}
+
+// requests the manifest of a bundle from its seeders and waits for the first valid reply
+func fetchBundleManifest(bundleHash string) *models.BundleManifest {
+	manifest := getBundleManifest(bundleHash)
+	if manifest != nil {
+		return manifest
+	}
+
+	for _, seeder := range GetSeeders(bundleHash) {
+		session, err := sessionmanager.GetSession(seeder)
+		if err == nil && peerSupports(seeder, constants.FeatureBundles) {
+			RequestBundleManifest(session, bundleHash)
+		}
+	}
+
+	for i := 0; i < constants.BundleManifestReceiveTimeout; i++ {
+		time.Sleep(time.Second)
+		manifest = getBundleManifest(bundleHash)
+		if manifest != nil {
+			return manifest
+		}
+	}
+	return nil
+}
+
+//GetBundleManifest returns the files in a bundle, fetching the manifest from a seeder when needed
+func GetBundleManifest(Hash string) []models.BundleFile {
+	manifest := fetchBundleManifest(Hash)
+	if manifest == nil {
+		pushError("Error on get bundle", "No manifest received for bundle: "+Hash)
+		return []models.BundleFile{}
+	}
+	return manifest.Files
+}
+
+//DownloadBundle downloads the files of a bundle into a folder named after the bundle, all files are downloaded when Paths is empty
+func DownloadBundle(Hash string, Paths []string) bool {
+	listing := getListedFileByHash(Hash)
+	if listing == nil || !listing.IsBundle {
+		pushError("Error on download bundle", "No listed bundle with hash: "+Hash)
+		return false
+	}
+
+	manifest := fetchBundleManifest(Hash)
+	if manifest == nil {
+		pushError("Error on download bundle", "No manifest received for bundle: "+listing.FileName)
+		return false
+	}
+
+	folderName := filepath.Base(manifest.Name)
+	if folderName != manifest.Name || folderName == "." || folderName == ".." {
+		pushError("Error on download bundle", "Invalid bundle name: "+manifest.Name)
+		return false
+	}
+
+	//Select the requested files, all when no paths are given
+	selected := []models.BundleFile{}
+	for _, bundleFile := range manifest.Files {
+		if !isValidBundlePath(bundleFile.Path) {
+			pushError("Error on download bundle", "Invalid path in bundle manifest: "+bundleFile.Path)
+			return false
+		}
+		if len(Paths) == 0 || containsString(Paths, bundleFile.Path) {
+			selected = append(selected, bundleFile)
+		}
+	}
+	if len(selected) != len(Paths) && len(Paths) > 0 {
+		pushError("Error on download bundle", "Not all requested paths are part of "+manifest.Name)
+		return false
+	}
+
+	remoteFolder, err := GetDownloadFolderPath()
+	if err != nil {
+		pushError("Error on download bundle", "Could not access download folder at path: "+remoteFolder)
+		return false
+	}
+	bundleFolder := filepath.Join(remoteFolder, folderName)
+
+	//Store the bundle so we list it ourselves once all files are downloaded
+	_, err = dbGetBundle(Hash)
+	if err != nil {
+		dbInsertBundle(models.Bundle{
+			BundleHash: Hash,
+			Topic:      listing.Topic,
+			Manifest:   getBundleManifestBytes(Hash),
+		})
+	}
+
+	pushNotification("Download Started", manifest.Name)
+
+	for _, bundleFile := range selected {
+		//Files we already have or download are skipped, so a bundle can be extended with more of its files
+		_, err := dbGetFile(bundleFile.FileHash)
+		if err == nil {
+			continue
+		}
+
+		filePath := filepath.Join(bundleFolder, filepath.FromSlash(bundleFile.Path))
+		err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+		if err != nil {
+			pushError("Error on download bundle", "Could not create folder for "+bundleFile.Path)
+			return false
+		}
+
+		file := &models.File{
+			FileName:   manifest.Name + "/" + bundleFile.Path,
+			FileSize:   bundleFile.FileSize,
+			FileHash:   bundleFile.FileHash,
+			Topic:      listing.Topic,
+			BundleHash: Hash,
+			PeerHints:  getPeerHints(Hash),
+		}
+		if !downloadFile(file, filePath) {
+			return false
+		}
+	}
+	return true
+}
+
+// adds a bundle seeder as seeder of every file in the bundle, when the manifest is not known yet this happens once it arrives
+func addBundleSeeder(bundleHash string, seeder string) {
+	manifest := getBundleManifest(bundleHash)
+	if manifest == nil {
+		return
+	}
+
+	for _, bundleFile := range manifest.Files {
+		AddFileSeeder(bundleFile.FileHash, seeder)
+		SetFullSeeder(bundleFile.FileHash, seeder)
+	}
+}
+
+// removes a bundle seeder from every file in the bundle
+func removeBundleSeeder(bundleHash string, seeder string) {
+	manifest := getBundleManifest(bundleHash)
+	if manifest == nil {
+		return
+	}
+
+	for _, bundleFile := range manifest.Files {
+		RemoveFileSeeder(bundleFile.FileHash, seeder)
+	}
+}
+
+// removes a bundle and its files from surge db and optionally from disk
+func removeBundle(bundle *models.Bundle, FromDisk bool) bool {
+	manifest, err := parseBundleManifest(bundle.Manifest)
+	if err != nil {
+		pushError("Error on remove bundle", err.Error())
+		return false
+	}
+
+	for _, bundleFile := range manifest.Files {
+		file, err := dbGetFile(bundleFile.FileHash)
+		if err != nil || file.BundleHash != bundle.BundleHash {
+			continue
+		}
+
+		if FromDisk {
+			err = os.Remove(file.Path)
+			if err != nil {
+				pushError("Error on remove file from disk", err.Error())
+			}
+		}
+		dbDeleteFile(file.FileHash)
+		removeChunkHashes(file.FileHash)
+		removeFileBuckets(file.FileHash)
+		removeQueuedDownload(file.FileHash)
+	}
+
+	err = dbDeleteBundle(bundle.BundleHash)
+	if err != nil {
+		pushError("Error on remove bundle (read db)", err.Error())
+		return false
+	}
+
+	log.Println("Removing bundle:", manifest.Name, bundle.BundleHash, "from disk:", FromDisk)
+	AnnounceRemoveFile(bundle.Topic, bundle.BundleHash)
+	return true
+}
+
+// announces a bundle once the last of its files finished downloading
+func announceBundleIfComplete(bundleHash string) {
+	bundle, err := dbGetBundle(bundleHash)
+	if err != nil {
+		return
+	}
+	manifest, err := parseBundleManifest(bundle.Manifest)
+	if err != nil || !isBundleSeeding(manifest) {
+		return
+	}
+	AnnounceNewBundle(bundle, manifest)
+}
+
+// RequestBundleManifest sends a request for the manifest of a bundle
+func RequestBundleManifest(Session *sessionmanager.Session, BundleHash string) bool {
+	msg := &pb.SurgeMessage{
+		FileID: BundleHash,
+	}
+	msgSerialized, err := proto.Marshal(msg)
+	if err != nil {
+		log.Println("Failed to encode bundle manifest request:", err)
+		return false
+	}
+
+	_, err = SessionWrite(Session, msgSerialized, constants.SurgeBundleManifestID)
+	if err != nil {
+		log.Println("Failed to request bundle manifest", err)
+		return false
+	}
+	return true
+}
+
+// TransmitBundleManifest sends the manifest of a bundle we know
+func TransmitBundleManifest(Session *sessionmanager.Session, BundleHash string) {
+	defer RecoverAndLog()
+
+	bundle, err := dbGetBundle(BundleHash)
+	if err != nil {
+		return
+	}
+
+	dataReply := &pb.SurgeMessage{
+		FileID: BundleHash,
+		Data:   bundle.Manifest,
+	}
+	dataReplySerialized, err := proto.Marshal(dataReply)
+	if err != nil {
+		log.Println("Error on transmit bundle manifest - serialization error", err.Error())
+		return
+	}
+
+	_, err = SessionWrite(Session, dataReplySerialized, constants.SurgeBundleManifestID)
+	if err != nil {
+		log.Println("Error on transmit bundle manifest - failed to write to session", err.Error())
+	}
+}
+
+func processBundleManifest(Session *sessionmanager.Session, Data []byte) {
+	surgeMessage := &pb.SurgeMessage{}
+	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
+		log.Println("Failed to parse bundle manifest message:", err)
+		return
+	}
+
+	//Data nil means its a request for our manifest
+	if surgeMessage.Data == nil {
+		TransmitBundleManifest(Session, surgeMessage.FileID)
+		return
+	}
+
+	if getBundleManifest(surgeMessage.FileID) != nil {
+		return
+	}
+
+	_, err := verifyBundleManifest(surgeMessage.FileID, surgeMessage.Data)
+	if err != nil {
+		log.Println("Rejected bundle manifest for", surgeMessage.FileID, "from", Session.Session.RemoteAddr().String(), err)
+		return
+	}
+
+	bundleManifestLock.Lock()
+	bundleManifestMap[surgeMessage.FileID] = surgeMessage.Data
+	bundleManifestLock.Unlock()
+
+	//Every seeder of the bundle seeds its files
+	for _, seeder := range GetSeeders(surgeMessage.FileID) {
+		addBundleSeeder(surgeMessage.FileID, seeder)
+	}
+}
+
+// checks a received manifest against the bundle hash it was requested for
+func verifyBundleManifest(bundleHash string, manifestBytes []byte) (*models.BundleManifest, error) {
+	if hashBundleManifest(manifestBytes) != bundleHash {
+		return nil, errors.New("manifest does not match bundle hash")
+	}
+
+	manifest, err := parseBundleManifest(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, bundleFile := range manifest.Files {
+		if !isValidBundlePath(bundleFile.Path) {
+			return nil, errors.New("invalid path in manifest " + bundleFile.Path)
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the catalog of remote files
+	Listings are indexed by hash and by every topic they were announced in and remember when they were first and last announced,
+	listings that were not announced for a while can be expired.
+*/
+
+package catalog
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/models"
+)
+
+//Listing is a remote file with the times it was first and last announced in unix seconds
+type Listing struct {
+	File      models.File
+	Topics    []string //every topic the file was announced in, the first is the topic of File
+	FirstSeen int64
+	LastSeen  int64
+}
+
+//Catalog indexes remote files by hash and by topic, it is safe for concurrent use
+type Catalog struct {
+	listings map[string]*Listing
+	topics   map[string]map[string]bool //hashes by topic
+	lock     sync.RWMutex
+}
+
+//New creates an empty catalog
+func New() *Catalog {
+	return &Catalog{
+		listings: map[string]*Listing{},
+		topics:   map[string]map[string]bool{},
+	}
+}
+
+//Add lists a file or refreshes its last seen time when it is listed already, a file announced in another topic is listed there too
+//returns true when the file is new
+func (c *Catalog) Add(file models.File) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now().Unix()
+	listing, exists := c.listings[file.FileHash]
+	if exists {
+		listing.LastSeen = now
+	} else {
+		listing = &Listing{
+			File:      file,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		c.listings[file.FileHash] = listing
+	}
+
+	if !c.topics[file.Topic][file.FileHash] {
+		if _, exists := c.topics[file.Topic]; !exists {
+			c.topics[file.Topic] = map[string]bool{}
+		}
+		c.topics[file.Topic][file.FileHash] = true
+		listing.Topics = append(listing.Topics, file.Topic)
+	}
+	return !exists
+}
+
+//Touch refreshes the last seen time of a listing
+func (c *Catalog) Touch(hash string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if listing, exists := c.listings[hash]; exists {
+		listing.LastSeen = time.Now().Unix()
+	}
+}
+
+//Get returns the listed file by hash
+func (c *Catalog) Get(hash string) (models.File, bool) {
+	listing, exists := c.GetListing(hash)
+	return listing.File, exists
+}
+
+//GetListing returns the listing by hash
+func (c *Catalog) GetListing(hash string) (Listing, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	listing, exists := c.listings[hash]
+	if !exists {
+		return Listing{}, false
+	}
+	return copyListing(listing), true
+}
+
+//Topic returns the listings of a topic, their file is listed in that topic
+func (c *Catalog) Topic(topic string) []Listing {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	listings := []Listing{}
+	for hash := range c.topics[topic] {
+		listing := copyListing(c.listings[hash])
+		listing.File.Topic = topic
+		listings = append(listings, listing)
+	}
+	return listings
+}
+
+//CountTopic returns the number of listings of a topic
+func (c *Catalog) CountTopic(topic string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.topics[topic])
+}
+
+//All returns every listing
+func (c *Catalog) All() []Listing {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	listings := []Listing{}
+	for _, listing := range c.listings {
+		listings = append(listings, copyListing(listing))
+	}
+	return listings
+}
+
+//Len returns the number of listings
+func (c *Catalog) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return len(c.listings)
+}
+
+//Remove removes a listing by hash
+func (c *Catalog) Remove(hash string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.remove(hash)
+}
+
+//RemoveWhere removes the listings matching the test and returns them
+func (c *Catalog) RemoveWhere(test func(listing Listing) bool) []Listing {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	removed := []Listing{}
+	for hash, listing := range c.listings {
+		if test(copyListing(listing)) {
+			removed = append(removed, copyListing(listing))
+			c.remove(hash)
+		}
+	}
+	return removed
+}
+
+//Expire removes the listings last seen before the given unix time and returns them
+func (c *Catalog) Expire(before int64) []Listing {
+	return c.RemoveWhere(func(listing Listing) bool {
+		return listing.LastSeen < before
+	})
+}
+
+// call with lock held
+func (c *Catalog) remove(hash string) {
+	listing, exists := c.listings[hash]
+	if !exists {
+		return
+	}
+
+	delete(c.listings, hash)
+	for _, topic := range listing.Topics {
+		delete(c.topics[topic], hash)
+		if len(c.topics[topic]) == 0 {
+			delete(c.topics, topic)
+		}
+	}
+}
+
+// returns a copy of a listing that shares no topics with the original, call with lock held
+func copyListing(listing *Listing) Listing {
+	copied := *listing
+	copied.Topics = append([]string{}, listing.Topics...)
+	return copied
+}
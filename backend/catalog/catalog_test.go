@@ -0,0 +1,163 @@
+package catalog
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/rule110-io/surge/backend/models"
+)
+
+func file(hash string, topic string) models.File {
+	return models.File{FileHash: hash, FileName: hash + ".txt", Topic: topic}
+}
+
+func hashes(listings []Listing) []string {
+	result := []string{}
+	for _, listing := range listings {
+		result = append(result, listing.File.FileHash)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func expectHashes(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c := New()
+
+	if !c.Add(file("a", "surge")) {
+		t.Fatal("first add of a is not new")
+	}
+	if c.Add(file("a", "surge")) {
+		t.Fatal("second add of a is new")
+	}
+	if c.Add(file("a", "movies")) {
+		t.Fatal("add of a in another topic is new")
+	}
+
+	listing, exists := c.GetListing("a")
+	if !exists {
+		t.Fatal("a is not listed")
+	}
+	expectHashes(t, listing.Topics, "surge", "movies")
+	if listing.File.Topic != "surge" {
+		t.Fatalf("file topic is %s, want the first topic surge", listing.File.Topic)
+	}
+	if c.Len() != 1 {
+		t.Fatalf("catalog has %d listings, want 1", c.Len())
+	}
+}
+
+func TestTopic(t *testing.T) {
+	c := New()
+	c.Add(file("a", "surge"))
+	c.Add(file("b", "surge"))
+	c.Add(file("a", "movies"))
+	c.Add(file("c", "movies"))
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{topic: "surge", want: []string{"a", "b"}},
+		{topic: "movies", want: []string{"a", "c"}},
+		{topic: "music"},
+	}
+
+	for _, test := range tests {
+		listings := c.Topic(test.topic)
+		expectHashes(t, hashes(listings), test.want...)
+		for _, listing := range listings {
+			if listing.File.Topic != test.topic {
+				t.Fatalf("listing %s of topic %s has file topic %s", listing.File.FileHash, test.topic, listing.File.Topic)
+			}
+		}
+		if c.CountTopic(test.topic) != len(test.want) {
+			t.Fatalf("topic %s counts %d listings, want %d", test.topic, c.CountTopic(test.topic), len(test.want))
+		}
+	}
+}
+
+func TestListingsAreCopies(t *testing.T) {
+	c := New()
+	c.Add(file("a", "surge"))
+
+	listing, _ := c.GetListing("a")
+	listing.Topics[0] = "changed"
+	listing.File.FileName = "changed"
+
+	listing, _ = c.GetListing("a")
+	if listing.Topics[0] != "surge" || listing.File.FileName != "a.txt" {
+		t.Fatalf("changing a returned listing changed the catalog: %+v", listing)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	tests := []struct {
+		name        string
+		lastSeen    map[string]int64
+		before      int64
+		wantExpired []string
+		wantKept    []string
+	}{
+		{name: "nothing expired", lastSeen: map[string]int64{"a": 100, "b": 200}, before: 50, wantKept: []string{"a", "b"}},
+		{name: "some expired", lastSeen: map[string]int64{"a": 100, "b": 200}, before: 150, wantExpired: []string{"a"}, wantKept: []string{"b"}},
+		{name: "seen at the cutoff is kept", lastSeen: map[string]int64{"a": 100}, before: 100, wantKept: []string{"a"}},
+		{name: "all expired", lastSeen: map[string]int64{"a": 100, "b": 200}, before: 300, wantExpired: []string{"a", "b"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := New()
+			for hash, lastSeen := range test.lastSeen {
+				c.Add(file(hash, "surge"))
+				c.Add(file(hash, "movies"))
+				c.listings[hash].LastSeen = lastSeen
+			}
+
+			expectHashes(t, hashes(c.Expire(test.before)), test.wantExpired...)
+			expectHashes(t, hashes(c.All()), test.wantKept...)
+			expectHashes(t, hashes(c.Topic("surge")), test.wantKept...)
+			expectHashes(t, hashes(c.Topic("movies")), test.wantKept...)
+		})
+	}
+}
+
+func TestTouchKeepsListing(t *testing.T) {
+	c := New()
+	c.Add(file("a", "surge"))
+	c.listings["a"].LastSeen = 100
+
+	c.Touch("a")
+	if expired := c.Expire(1000); len(expired) != 0 {
+		t.Fatalf("touched listing expired: %v", hashes(expired))
+	}
+}
+
+func TestRemove(t *testing.T) {
+	c := New()
+	c.Add(file("a", "surge"))
+	c.Add(file("a", "movies"))
+	c.Add(file("b", "movies"))
+
+	c.Remove("a")
+	if _, exists := c.Get("a"); exists {
+		t.Fatal("removed listing a still exists")
+	}
+	expectHashes(t, hashes(c.Topic("surge")))
+	expectHashes(t, hashes(c.Topic("movies")), "b")
+	if _, exists := c.topics["surge"]; exists {
+		t.Fatal("empty topic surge is still indexed")
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the per chunk hashes of files
+	Seeders compute a sha256 digest per chunk and serve the list to downloaders
+	so corrupt chunks are rejected on arrival instead of after the whole download.
+	The list is not bound to the file hash, so it is only used once ChunkHashesQuorum seeders offered the same list,
+	and dropped again when chunks of several seeders fail against it. Files fewer seeders serve hashes for are only verified after download.
+*/
+
+package surge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	pb "github.com/rule110-io/surge/backend/payloads"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+	"google.golang.org/protobuf/proto"
+)
+
+//Chunk hashes by file hash, concatenated sha256 digests in chunk order, nil when the db has none
+var chunkHashesMap map[string][]byte
+var chunkHashesLock = sync.Mutex{}
+
+//Chunk hashes offered by seeders by file hash and seeder, until enough seeders agree
+var chunkHashOffers map[string]map[string][]byte
+
+//Seeders whose chunks failed verification by file hash
+var chunkHashFailures map[string]map[string]bool
+
+//Seeders whose chunk hashes were dropped by file hash, their offers are ignored
+var chunkHashesDistrusted map[string]map[string]bool
+
+// returns the chunk hashes for a file, nil when we do not know them
+func getChunkHashes(fileHash string) []byte {
+	chunkHashesLock.Lock()
+	defer chunkHashesLock.Unlock()
+
+	hashes, exists := chunkHashesMap[fileHash]
+	if exists {
+		return hashes
+	}
+
+	//Misses are cached as well, every verified chunk asks
+	hashes, err := dbGetChunkHashes(fileHash)
+	if err != nil {
+		hashes = nil
+	}
+	chunkHashesMap[fileHash] = hashes
+	return hashes
+}
+
+// stores the chunk hashes for a file
+func setChunkHashes(fileHash string, hashes []byte) {
+	chunkHashesLock.Lock()
+	defer chunkHashesLock.Unlock()
+
+	chunkHashesMap[fileHash] = hashes
+	dbInsertChunkHashes(fileHash, hashes)
+}
+
+// removes the chunk hashes for a file
+func removeChunkHashes(fileHash string) {
+	chunkHashesLock.Lock()
+	defer chunkHashesLock.Unlock()
+
+	delete(chunkHashesMap, fileHash)
+	delete(chunkHashOffers, fileHash)
+	delete(chunkHashFailures, fileHash)
+	delete(chunkHashesDistrusted, fileHash)
+	dbDeleteChunkHashes(fileHash)
+}
+
+// verifies a chunk against the chunk hashes of the file, chunks of files without known hashes are accepted
+func verifyChunk(fileHash string, chunkID int32, chunk []byte) bool {
+	hashes := getChunkHashes(fileHash)
+	if hashes == nil {
+		return true
+	}
+
+	offset := int(chunkID) * sha256.Size
+	if chunkID < 0 || offset+sha256.Size > len(hashes) {
+		return false
+	}
+
+	chunkHash := sha256.Sum256(chunk)
+	return bytes.Equal(chunkHash[:], hashes[offset:offset+sha256.Size])
+}
+
+// requests the chunk hashes from all seeders of a file and waits until enough of them agree
+func fetchChunkHashes(fileHash string) bool {
+	sessions := []*sessionmanager.Session{}
+	for _, seeder := range GetSeeders(fileHash) {
+		if isChunkHashesDistrusted(fileHash, seeder) {
+			continue
+		}
+		session, err := sessionmanager.GetSession(seeder)
+		if err == nil && peerSupports(seeder, constants.FeatureChunkHashes) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	requested := 0
+	for _, session := range sessions {
+		if RequestChunkHashes(session, fileHash) {
+			requested++
+		}
+	}
+
+	//Hashes of a single seeder could be made up, they count towards the quorum once more seeders serve the file
+	if requested < constants.ChunkHashesQuorum {
+		log.Println("Too few seeders serve chunk hashes for", fileHash, "chunks will only be verified after download")
+		return false
+	}
+
+	for i := 0; i < constants.ChunkHashesReceiveTimeout; i++ {
+		if getChunkHashes(fileHash) != nil {
+			return true
+		}
+		time.Sleep(time.Second)
+	}
+
+	log.Println("No chunk hashes received for", fileHash, "chunks will only be verified after download")
+	return false
+}
+
+// RequestChunkHashes sends a request for the chunk hashes of a file
+func RequestChunkHashes(Session *sessionmanager.Session, FileID string) bool {
+	msg := &pb.SurgeMessage{
+		FileID: FileID,
+	}
+	msgSerialized, err := proto.Marshal(msg)
+	if err != nil {
+		log.Println("Failed to encode chunk hashes request:", err)
+		return false
+	}
+
+	_, err = SessionWrite(Session, msgSerialized, constants.SurgeChunkHashesID)
+	if err != nil {
+		log.Println("Failed to request chunk hashes", err)
+		return false
+	}
+	return true
+}
+
+// TransmitChunkHashes sends the chunk hashes of a seeded file, they are computed first for files seeded before chunk hashes existed
+func TransmitChunkHashes(Session *sessionmanager.Session, FileID string) {
+	defer RecoverAndLog()
+
+	fileInfo, err := dbGetFile(FileID)
+	if err != nil || !fileInfo.IsUploading {
+		return
+	}
+
+	hashes := getChunkHashes(FileID)
+	if hashes == nil {
+		fileHash, computedHashes, err := HashFileChunks(fileInfo.Path)
+		if err != nil || fileHash != FileID {
+			log.Println("Error on transmit chunk hashes - file could not be hashed", FileID)
+			return
+		}
+		setChunkHashes(FileID, computedHashes)
+		hashes = computedHashes
+	}
+
+	dataReply := &pb.SurgeMessage{
+		FileID: FileID,
+		Data:   hashes,
+	}
+	dataReplySerialized, err := proto.Marshal(dataReply)
+	if err != nil {
+		log.Println("Error on transmit chunk hashes - serialization error", err.Error())
+		return
+	}
+
+	_, err = SessionWrite(Session, dataReplySerialized, constants.SurgeChunkHashesID)
+	if err != nil {
+		log.Println("Error on transmit chunk hashes - failed to write to session", err.Error())
+	}
+}
+
+func processChunkHashes(Session *sessionmanager.Session, Data []byte) {
+	surgeMessage := &pb.SurgeMessage{}
+	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
+		log.Println("Failed to parse chunk hashes message:", err)
+		return
+	}
+
+	//Data nil means its a request for our hashes
+	if surgeMessage.Data == nil {
+		TransmitChunkHashes(Session, surgeMessage.FileID)
+		return
+	}
+
+	//Only accept hashes for files we are downloading and do not have hashes for yet
+	fileInfo, err := dbGetFile(surgeMessage.FileID)
+	if err != nil || !fileInfo.IsDownloading || getChunkHashes(surgeMessage.FileID) != nil {
+		return
+	}
+
+	if len(surgeMessage.Data) != fileInfo.NumChunks*sha256.Size {
+		log.Println("Received chunk hashes with invalid length for", surgeMessage.FileID, "from", Session.Session.RemoteAddr().String())
+		return
+	}
+
+	if !offerChunkHashes(surgeMessage.FileID, Session.Session.RemoteAddr().String(), surgeMessage.Data) {
+		return
+	}
+
+	setChunkHashes(surgeMessage.FileID, surgeMessage.Data)
+	log.Println("Chunk hashes received for", fileInfo.FileName)
+}
+
+// records the chunk hashes a seeder offered, returns whether enough seeders offered the same hashes to use them
+func offerChunkHashes(fileHash string, seeder string, hashes []byte) bool {
+	chunkHashesLock.Lock()
+	defer chunkHashesLock.Unlock()
+
+	if chunkHashesDistrusted[fileHash][seeder] {
+		return false
+	}
+	if chunkHashOffers[fileHash] == nil {
+		chunkHashOffers[fileHash] = make(map[string][]byte)
+	}
+	chunkHashOffers[fileHash][seeder] = hashes
+
+	agreeing := 0
+	for _, offered := range chunkHashOffers[fileHash] {
+		if bytes.Equal(offered, hashes) {
+			agreeing++
+		}
+	}
+	return agreeing >= constants.ChunkHashesQuorum
+}
+
+// returns whether the chunk hashes of a seeder were dropped for a file
+func isChunkHashesDistrusted(fileHash string, seeder string) bool {
+	chunkHashesLock.Lock()
+	defer chunkHashesLock.Unlock()
+
+	return chunkHashesDistrusted[fileHash][seeder]
+}
+
+// records a chunk of a seeder that failed verification, when chunks of several seeders fail the chunk hashes are wrong rather than the seeders
+// the hashes are dropped, the seeders that offered them are no longer asked and the hashes are fetched again from the others
+func recordChunkHashFailure(fileHash string, seeder string) {
+	chunkHashesLock.Lock()
+
+	if chunkHashFailures[fileHash] == nil {
+		chunkHashFailures[fileHash] = make(map[string]bool)
+	}
+	chunkHashFailures[fileHash][seeder] = true
+	if len(chunkHashFailures[fileHash]) < constants.ChunkHashesDistrustSeeders {
+		chunkHashesLock.Unlock()
+		return
+	}
+
+	hashes := chunkHashesMap[fileHash]
+	if chunkHashesDistrusted[fileHash] == nil {
+		chunkHashesDistrusted[fileHash] = make(map[string]bool)
+	}
+	for offeredBy, offered := range chunkHashOffers[fileHash] {
+		if bytes.Equal(offered, hashes) {
+			chunkHashesDistrusted[fileHash][offeredBy] = true
+			delete(chunkHashOffers[fileHash], offeredBy)
+		}
+	}
+	delete(chunkHashFailures, fileHash)
+	delete(chunkHashesMap, fileHash)
+	dbDeleteChunkHashes(fileHash)
+	chunkHashesLock.Unlock()
+
+	log.Println("Chunks of several seeders failed verification for", fileHash, "dropped its chunk hashes")
+	go fetchChunkHashes(fileHash)
+}
@@ -0,0 +1,155 @@
+package surge
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/xujiajun/nutsdb"
+)
+
+// resets the chunk hash state on a fresh db
+func setupChunkHashes(t *testing.T) {
+	t.Helper()
+
+	opt := nutsdb.DefaultOptions
+	opt.Dir = t.TempDir()
+	var err error
+	db, err = nutsdb.Open(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	chunkHashesMap = make(map[string][]byte)
+	chunkHashOffers = make(map[string]map[string][]byte)
+	chunkHashFailures = make(map[string]map[string]bool)
+	chunkHashesDistrusted = make(map[string]map[string]bool)
+	InitializeFileSeedTracker()
+}
+
+func testChunkHashes(chunks ...string) []byte {
+	hashes := []byte{}
+	for _, chunk := range chunks {
+		hash := sha256.Sum256([]byte(chunk))
+		hashes = append(hashes, hash[:]...)
+	}
+	return hashes
+}
+
+func TestOfferChunkHashesQuorum(t *testing.T) {
+	good := testChunkHashes("a", "b")
+	bad := testChunkHashes("x", "y")
+
+	type offer struct {
+		seeder string
+		hashes []byte
+	}
+	tests := []struct {
+		name   string
+		offers []offer
+		want   []bool
+	}{
+		{name: "single seeder is not enough", offers: []offer{{"s1", good}}, want: []bool{false}},
+		{name: "same seeder twice is not enough", offers: []offer{{"s1", good}, {"s1", good}}, want: []bool{false, false}},
+		{name: "two seeders agree", offers: []offer{{"s1", good}, {"s2", good}}, want: []bool{false, true}},
+		{name: "two seeders disagree", offers: []offer{{"s1", good}, {"s2", bad}}, want: []bool{false, false}},
+		{name: "third seeder breaks the tie", offers: []offer{{"s1", good}, {"s2", bad}, {"s3", good}}, want: []bool{false, false, true}},
+		{name: "seeder changing its offer", offers: []offer{{"s1", bad}, {"s2", good}, {"s1", good}}, want: []bool{false, false, true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setupChunkHashes(t)
+			for i, offer := range test.offers {
+				if got := offerChunkHashes("file", offer.seeder, offer.hashes); got != test.want[i] {
+					t.Fatalf("offer %d of %s = %t, want %t", i, offer.seeder, got, test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyChunk(t *testing.T) {
+	setupChunkHashes(t)
+
+	if !verifyChunk("file", 0, []byte("anything")) {
+		t.Fatal("chunk of a file without hashes was rejected")
+	}
+
+	setChunkHashes("file", testChunkHashes("a", "b"))
+	tests := []struct {
+		chunkID int32
+		chunk   string
+		want    bool
+	}{
+		{chunkID: 0, chunk: "a", want: true},
+		{chunkID: 1, chunk: "b", want: true},
+		{chunkID: 1, chunk: "a", want: false},
+		{chunkID: 2, chunk: "c", want: false},
+		{chunkID: -1, chunk: "a", want: false},
+	}
+	for _, test := range tests {
+		if got := verifyChunk("file", test.chunkID, []byte(test.chunk)); got != test.want {
+			t.Fatalf("verifyChunk(%d, %q) = %t, want %t", test.chunkID, test.chunk, got, test.want)
+		}
+	}
+}
+
+func TestChunkHashesMissIsCached(t *testing.T) {
+	setupChunkHashes(t)
+
+	if getChunkHashes("file") != nil {
+		t.Fatal("hashes of an unknown file are not nil")
+	}
+	if _, cached := chunkHashesMap["file"]; !cached {
+		t.Fatal("miss is not cached")
+	}
+
+	hashes := testChunkHashes("a")
+	setChunkHashes("file", hashes)
+	if !bytes.Equal(getChunkHashes("file"), hashes) {
+		t.Fatal("set hashes replace the cached miss")
+	}
+
+	//Read back from the db
+	delete(chunkHashesMap, "file")
+	if !bytes.Equal(getChunkHashes("file"), hashes) {
+		t.Fatal("hashes were not stored in the db")
+	}
+}
+
+func TestChunkHashFailuresDistrustOffers(t *testing.T) {
+	setupChunkHashes(t)
+
+	bad := testChunkHashes("x", "y")
+	offerChunkHashes("file", "s1", bad)
+	if !offerChunkHashes("file", "s2", bad) {
+		t.Fatal("agreeing offers did not reach the quorum")
+	}
+	setChunkHashes("file", bad)
+
+	//Chunks of one seeder failing could be that seeder
+	recordChunkHashFailure("file", "s3")
+	recordChunkHashFailure("file", "s3")
+	if getChunkHashes("file") == nil {
+		t.Fatal("hashes dropped after failures of a single seeder")
+	}
+
+	//Chunks of several seeders failing are the hashes
+	recordChunkHashFailure("file", "s4")
+	if getChunkHashes("file") != nil {
+		t.Fatal("hashes kept after failures of several seeders")
+	}
+	if !isChunkHashesDistrusted("file", "s1") || !isChunkHashesDistrusted("file", "s2") {
+		t.Fatal("seeders that offered the dropped hashes are still trusted")
+	}
+	if isChunkHashesDistrusted("file", "s3") {
+		t.Fatal("seeder that did not offer the dropped hashes is distrusted")
+	}
+
+	//Distrusted seeders can not bring the hashes back
+	if offerChunkHashes("file", "s1", bad) || offerChunkHashes("file", "s2", bad) {
+		t.Fatal("offer of a distrusted seeder counted")
+	}
+}
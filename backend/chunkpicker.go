@@ -0,0 +1,187 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the chunk pickers
+	A chunk picker decides in which order the chunks of a download are requested
+*/
+
+package surge
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+)
+
+//ChunkPicker decides which chunk of a download is requested next
+type ChunkPicker interface {
+	//Next returns the next chunk to request, false when no chunks are pending
+	Next() (int, bool)
+
+	//Requeue adds a chunk that failed to be fetched again
+	Requeue(chunkID int)
+}
+
+//interval at which the rarest first picker refreshes chunk availability
+const availabilityRefreshInterval = time.Second
+
+func newChunkPicker(strategy string, chunks []int, availability func(chunkID int) int) ChunkPicker {
+	pending := make([]int, len(chunks))
+	copy(pending, chunks)
+
+	switch strategy {
+	case constants.ChunkStrategyRandom:
+		return &randomChunkPicker{
+			pending: pending,
+			random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	case constants.ChunkStrategyRarestFirst:
+		return &rarestFirstChunkPicker{
+			pending:      pending,
+			availability: availability,
+			random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	default:
+		sort.Ints(pending)
+		return &sequentialChunkPicker{
+			pending: pending,
+		}
+	}
+}
+
+//IsValidChunkStrategy returns whether the strategy is known
+func IsValidChunkStrategy(strategy string) bool {
+	return strategy == constants.ChunkStrategySequential ||
+		strategy == constants.ChunkStrategyRandom ||
+		strategy == constants.ChunkStrategyRarestFirst
+}
+
+// sequentialChunkPicker requests chunks in file order, requeued chunks go first so files can be streamed
+type sequentialChunkPicker struct {
+	pending []int
+	lock    sync.Mutex
+}
+
+func (p *sequentialChunkPicker) Next() (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.pending) == 0 {
+		return 0, false
+	}
+	chunkID := p.pending[0]
+	p.pending = p.pending[1:]
+	return chunkID, true
+}
+
+func (p *sequentialChunkPicker) Requeue(chunkID int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	//Keep pending sorted
+	index := sort.SearchInts(p.pending, chunkID)
+	p.pending = append(p.pending, 0)
+	copy(p.pending[index+1:], p.pending[index:])
+	p.pending[index] = chunkID
+}
+
+// randomChunkPicker requests chunks in random order
+type randomChunkPicker struct {
+	pending []int
+	random  *rand.Rand
+	lock    sync.Mutex
+}
+
+func (p *randomChunkPicker) Next() (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.pending) == 0 {
+		return 0, false
+	}
+
+	//Swap a random chunk to the end and take it
+	index := p.random.Intn(len(p.pending))
+	last := len(p.pending) - 1
+	p.pending[index], p.pending[last] = p.pending[last], p.pending[index]
+
+	chunkID := p.pending[last]
+	p.pending = p.pending[:last]
+	return chunkID, true
+}
+
+func (p *randomChunkPicker) Requeue(chunkID int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending = append(p.pending, chunkID)
+}
+
+// rarestFirstChunkPicker requests chunks held by the fewest seeders first, ties are broken randomly
+type rarestFirstChunkPicker struct {
+	pending      []int
+	availability func(chunkID int) int
+	random       *rand.Rand
+	lastSorted   time.Time
+	lock         sync.Mutex
+}
+
+func (p *rarestFirstChunkPicker) Next() (int, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.pending) == 0 {
+		return 0, false
+	}
+
+	//Availability changes as seeders come and go, reorder pending chunks periodically
+	if time.Since(p.lastSorted) > availabilityRefreshInterval {
+		p.sortPending()
+	}
+
+	chunkID := p.pending[0]
+	p.pending = p.pending[1:]
+	return chunkID, true
+}
+
+func (p *rarestFirstChunkPicker) Requeue(chunkID int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.pending = append(p.pending, chunkID)
+
+	//Force a reorder so the requeued chunk takes its place
+	p.lastSorted = time.Time{}
+}
+
+func (p *rarestFirstChunkPicker) sortPending() {
+	p.random.Shuffle(len(p.pending), func(i, j int) { p.pending[i], p.pending[j] = p.pending[j], p.pending[i] })
+
+	availability := make(map[int]int, len(p.pending))
+	for _, chunkID := range p.pending {
+		availability[chunkID] = p.availability(chunkID)
+	}
+	sort.SliceStable(p.pending, func(i, j int) bool {
+		return availability[p.pending[i]] < availability[p.pending[j]]
+	})
+
+	p.lastSorted = time.Now()
+}
+
+// returns a function counting the seeders that have a chunk of the file
+func chunkAvailability(fileHash string) func(chunkID int) int {
+	return func(chunkID int) int {
+		count := 0
+		for _, seeder := range GetSeeders(fileHash) {
+			if SeederHasChunk(fileHash, seeder, chunkID) {
+				count++
+			}
+		}
+		return count
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the chunk replies other than the chunk itself
+	Seeders reject requests they can not serve and answer busy when they have no room,
+	downloaders cancel requests they no longer need. Both sides can move on right away instead of waiting for a timeout.
+*/
+
+package surge
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/mutexes"
+	pb "github.com/rule110-io/surge/backend/payloads"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+	"google.golang.org/protobuf/proto"
+)
+
+//A reject or busy reply received for a chunk in transit
+type chunkRefusal struct {
+	ID     byte
+	Reason string
+}
+
+//chunks in transit the seeder refused, keyed like chunksInTransit
+var chunksRefused map[string]chunkRefusal
+
+//chunk requests a seeder is handling, keyed by peer address, file and chunk, canceled requests are removed
+var pendingTransmits map[string]bool
+
+// writes a chunk reply frame without data other than the reason
+func writeChunkReply(Session *sessionmanager.Session, FileID string, ChunkID int32, ID byte, Reason string) bool {
+	//Older peers do not know these frames and wait for the timeout instead
+	if !peerSupports(Session.Session.RemoteAddr().String(), constants.FeatureChunkReplies) {
+		return false
+	}
+
+	msg := &pb.SurgeMessage{
+		FileID:  FileID,
+		ChunkID: ChunkID,
+		Data:    []byte(Reason),
+	}
+	msgSerialized, err := proto.Marshal(msg)
+	if err != nil {
+		log.Println("Failed to encode chunk reply:", err)
+		return false
+	}
+
+	_, err = SessionWrite(Session, msgSerialized, ID)
+	if err != nil {
+		log.Println("Failed to write chunk reply", err)
+		return false
+	}
+	return true
+}
+
+// RejectChunk tells the downloader a requested chunk will not be served
+func RejectChunk(Session *sessionmanager.Session, FileID string, ChunkID int32, Reason string) bool {
+	return writeChunkReply(Session, FileID, ChunkID, constants.SurgeChunkRejectID, Reason)
+}
+
+// SendChunkBusy tells the downloader we have no room for the request right now
+func SendChunkBusy(Session *sessionmanager.Session, FileID string, ChunkID int32) bool {
+	return writeChunkReply(Session, FileID, ChunkID, constants.SurgeChunkBusyID, "")
+}
+
+// CancelChunk tells the seeder a requested chunk is no longer needed
+func CancelChunk(Session *sessionmanager.Session, FileID string, ChunkID int32) bool {
+	return writeChunkReply(Session, FileID, ChunkID, constants.SurgeChunkCancelID, "")
+}
+
+func pendingTransmitKey(addr string, FileID string, ChunkID int32) string {
+	return addr + "_" + FileID + "_" + strconv.Itoa(int(ChunkID))
+}
+
+// registers a chunk request we are about to handle
+func addPendingTransmit(addr string, FileID string, ChunkID int32) {
+	mutexes.ChunkInTransitLock.Lock()
+	defer mutexes.ChunkInTransitLock.Unlock()
+
+	pendingTransmits[pendingTransmitKey(addr, FileID, ChunkID)] = true
+}
+
+// removes a chunk request once handled or canceled
+func removePendingTransmit(addr string, FileID string, ChunkID int32) {
+	mutexes.ChunkInTransitLock.Lock()
+	defer mutexes.ChunkInTransitLock.Unlock()
+
+	delete(pendingTransmits, pendingTransmitKey(addr, FileID, ChunkID))
+}
+
+// returns whether the downloader canceled a chunk request we are handling
+func isTransmitCanceled(addr string, FileID string, ChunkID int32) bool {
+	mutexes.ChunkInTransitLock.Lock()
+	defer mutexes.ChunkInTransitLock.Unlock()
+
+	return !pendingTransmits[pendingTransmitKey(addr, FileID, ChunkID)]
+}
+
+// handles a reject or busy reply, the waiting request job picks it up and requeues the chunk
+func processChunkRefusal(Session *sessionmanager.Session, Data []byte, ID byte) {
+	surgeMessage := &pb.SurgeMessage{}
+	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
+		log.Println("Failed to parse chunk reply:", err)
+		return
+	}
+
+	addr := Session.Session.RemoteAddr().String()
+	chunkKey := surgeMessage.FileID + "_" + strconv.Itoa(int(surgeMessage.ChunkID))
+
+	mutexes.ChunkInTransitLock.Lock()
+	if !chunksInTransit[chunkKey] {
+		mutexes.ChunkInTransitLock.Unlock()
+		return
+	}
+	chunksInTransit[chunkKey] = false
+	delete(chunkRequestTimes, chunkKey)
+	chunksRefused[chunkKey] = chunkRefusal{
+		ID:     ID,
+		Reason: string(surgeMessage.Data),
+	}
+	mutexes.ChunkInTransitLock.Unlock()
+
+	mutexes.WorkerMapLock.Lock()
+	workerMap[addr]--
+	if workerMap[addr] < 0 {
+		workerMap[addr] = 0
+	}
+	mutexes.WorkerMapLock.Unlock()
+
+	if ID == constants.SurgeChunkRejectID {
+		log.Println("Chunk", surgeMessage.ChunkID, "of", surgeMessage.FileID, "rejected by", addr, string(surgeMessage.Data))
+
+		switch string(surgeMessage.Data) {
+		case constants.ChunkRejectNotSeeded:
+			//The seeder no longer has the file
+			RemoveFileSeeder(surgeMessage.FileID, addr)
+		case constants.ChunkRejectNotAvailable:
+			//Our copy of the seeders chunk map is outdated
+			RequestChunkMap(Session, surgeMessage.FileID)
+		}
+	}
+}
+
+// handles a cancel, the request is dropped when it was not transmitted yet
+func processChunkCancel(Session *sessionmanager.Session, Data []byte) {
+	surgeMessage := &pb.SurgeMessage{}
+	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
+		log.Println("Failed to parse chunk cancel:", err)
+		return
+	}
+
+	addr := Session.Session.RemoteAddr().String()
+	removeQueuedUpload(addr, surgeMessage.FileID, surgeMessage.ChunkID)
+	removePendingTransmit(addr, surgeMessage.FileID, surgeMessage.ChunkID)
+}
@@ -7,13 +7,16 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"log"
 
 	bitmap "github.com/boljen/go-bitmap"
 	nkn "github.com/nknorg/nkn-sdk-go"
+	"github.com/rule110-io/surge/backend/catalog"
 	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/magnet"
 	"github.com/rule110-io/surge/backend/messaging"
 	"github.com/rule110-io/surge/backend/models"
 	"github.com/rule110-io/surge/backend/mutexes"
@@ -34,7 +37,7 @@ var FrontendReady = false
 var workerMap map[string]int
 
 //ListedFiles are remote files that can be downloaded
-var ListedFiles []models.File
+var ListedFiles = catalog.New()
 
 var wailsContext *context.Context
 
@@ -44,6 +47,9 @@ var clientInitialized = false
 //The nkn client
 var client *nkn.MultiClient
 
+//The transport surge sessions are carried over
+var sessionTransport sessionmanager.Transport
+
 //NumClientsStruct .
 
 //var numClientsStore *wails.Store
@@ -82,6 +88,7 @@ func WailsBind(ctx *context.Context) {
 	go updateFileDataWorker()
 
 	FrontendReady = true
+	frontendEvents.SetReady()
 	log.Println("Frontend connected")
 }
 
@@ -98,11 +105,24 @@ func InitializeClient(args []string) bool {
 		pushError(err.Error(), "do you have an active internet connection?")
 	}
 
-	<-client.OnConnect.C
+	sessionTransport, err = createSessionTransport()
+	if err != nil {
+		pushError("Error on session transport", err.Error()+", falling back to nkn sessions.")
+		sessionTransport = sessionmanager.NewNKNTransport(client)
+	}
+	sessionmanager.Initialize(sessionTransport, onClientConnected, onClientDisconnected)
+
+	//Sessions over nkn need the network, other transports can serve peers while nkn is still connecting
+	if _, isNKN := sessionTransport.(*sessionmanager.NKNTransport); isNKN {
+		<-client.OnConnect.C
+		pushNotification("Client Connected", "Successfully connected to the NKN network")
+	} else {
+		go func() {
+			<-client.OnConnect.C
+			pushNotification("Client Connected", "Successfully connected to the NKN network")
+		}()
+	}
 	clientInitialized = true
-	sessionmanager.Initialize(client, onClientConnected, onClientDisconnected)
-
-	pushNotification("Client Connected", "Successfully connected to the NKN network")
 
 	client.Listen(nil)
 	go Listen()
@@ -124,13 +144,10 @@ func InitializeClient(args []string) bool {
 		}
 	}
 
-	for i := 0; i < len(filesOnDisk); i++ {
-		if filesOnDisk[i].IsDownloading {
-			go restartDownload(filesOnDisk[i].FileHash)
-		}
-	}
+	//Unfinished downloads continue in their queue order
+	restoreDownloadQueue(filesOnDisk)
 
-	messaging.Initialize(client, client.Account(), MessageReceived)
+	messaging.Initialize(client, client.Account(), sessionmanager.GetLocalAddress(), MessageReceived)
 
 	//Get the transaction fee setting
 	TransactionFee, err = DbReadSetting("defaultTxFee")
@@ -140,6 +157,7 @@ func InitializeClient(args []string) bool {
 	}
 
 	go autoSubscribeWorker()
+	go listingRefreshWorker()
 
 	go platform.WatchOSXHandler()
 
@@ -161,11 +179,24 @@ func StartClient(args []string) {
 	zeroBandwidthMap = make(map[string]bool)
 	fileBandwidthMap = make(map[string]models.BandwidthMA)
 	chunksInTransit = make(map[string]bool)
+	chunksRejected = make(map[string]bool)
+	chunksRefused = make(map[string]chunkRefusal)
+	chunkRequestTimes = make(map[string]time.Time)
+	pendingTransmits = make(map[string]bool)
+	chunkHashesMap = make(map[string][]byte)
+	chunkHashOffers = make(map[string]map[string][]byte)
+	chunkHashFailures = make(map[string]map[string]bool)
+	chunkHashesDistrusted = make(map[string]map[string]bool)
+	bundleManifestMap = make(map[string][]byte)
 
 	//Initialize our surge nkn client
 	InitializeFileSeedTracker()
 	InitializeTopicsManager()
+	InitializeHooks()
 	InitializeClient(args)
+	applyRateLimitSettings()
+	startUploadScheduler()
+	go fileStateFlushWorker()
 
 	//If we have no subs, subscribe to official
 	if len(topicsMap) == 0 {
@@ -184,6 +215,9 @@ func StopClient() {
 		AnnounceDisconnect(v.Name)
 	}
 	client.Close()
+
+	//Store the cached chunk maps before the db closes
+	flushFileStates()
 }
 
 //DownloadFileByHash Downloads a file by providing a hash
@@ -195,17 +229,47 @@ func DownloadFileByHash(Hash string) bool {
 		pushError("Error on download file", "No listed file with hash: "+Hash)
 		return false
 	}
+	file.PeerHints = getPeerHints(Hash)
 
-	pushNotification("Download Started", file.FileName)
+	//Directories are downloaded file by file
+	if file.IsBundle {
+		return DownloadBundle(Hash, nil)
+	}
 
 	remoteFolder, err := GetDownloadFolderPath()
 	if err != nil {
 		pushError("Error on download file", "Could not access download folder at path: "+remoteFolder)
 	}
 
+	//Listings come from peers, a name with path elements would place the file outside the download folder
+	if err := magnet.ValidateName(file.FileName); err != nil {
+		pushError("Error on download file", err.Error())
+		return false
+	}
+
 	// If the file doesn't exist allocate it
 	var path = remoteFolder + string(os.PathSeparator) + file.FileName
 
+	if !downloadFile(file, path) {
+		return false
+	}
+	pushNotification("Download Started", file.FileName)
+	return true
+}
+
+// allocates a remote file at the given path and queues its download
+func downloadFile(file *models.File, path string) bool {
+	//Files are downloaded once, paused downloads are resumed instead
+	existing, err := dbGetFile(file.FileHash)
+	if err == nil {
+		if existing.IsDownloading {
+			pushError("Error on download file", existing.FileName+" is already in your downloads.")
+		} else {
+			pushError("Error on download file", existing.FileName+" is already downloaded.")
+		}
+		return false
+	}
+
 	isAllocated := AllocateFile(path, file.FileSize)
 	if !isAllocated {
 		return false
@@ -214,29 +278,50 @@ func DownloadFileByHash(Hash string) bool {
 	numChunks := int((file.FileSize-1)/int64(constants.ChunkSize)) + 1
 
 	//When downloading from remote enter file into db
-	_, err = dbGetFile(Hash)
-	if err != nil {
-		file.Path = path
-		file.NumChunks = numChunks
-		file.ChunkMap = bitmap.NewSlice(numChunks)
-		file.IsDownloading = true
-		dbInsertFile(*file)
+	file.Path = path
+	file.NumChunks = numChunks
+	file.ChunkMap = bitmap.NewSlice(numChunks)
+	file.IsDownloading = true
+	file.ChunkStrategy = getDefaultChunkStrategy()
+	file.Priority = constants.DownloadPriorityDefault
+	dbInsertFile(*file)
+
+	//Let other downloaders know they can fetch chunks from us, files of a bundle are only listed as part of the bundle
+	if len(file.BundleHash) == 0 {
+		go AnnouncePartialFile(file)
 	}
 
-	//Create a random fetch sequence
-	randomChunks := make([]int, numChunks)
-	for i := 0; i < numChunks; i++ {
-		randomChunks[i] = i
+	return queueDownload(file.FileHash)
+}
+
+// starts a download for every file in a magnet link payload
+func startDownloadMagnetLinks(Magnetlinks string) bool {
+	files, errs := ParsePayloadString(Magnetlinks)
+	for _, err := range errs {
+		pushError("Invalid magnet link", err.Error())
+	}
+	if len(files) == 0 {
+		if len(errs) == 0 {
+			pushError("Invalid magnet link", "no surge link found")
+		}
+		return false
 	}
-	rand.Seed(time.Now().UnixNano())
-	//rand.Shuffle(len(randomChunks), func(i, j int) { randomChunks[i], randomChunks[j] = randomChunks[j], randomChunks[i] })
 
-	downloadChunks(file, randomChunks)
+	//Peers named by the links are seeders right away, the files need not be announced in a topic we subscribe to
+	for _, file := range files {
+		addPeerHints(file.FileHash, file.PeerHints, file.IsBundle)
+	}
 
+	//Queue in the order of the links
+	go func() {
+		for i := 0; i < len(files); i++ {
+			DownloadFileByHash(files[i].FileHash)
+		}
+	}()
 	return true
 }
 
-// Restarts a file download by providing a hash
+// Restarts a file download by providing a hash, it continues once it gets a slot in the download queue
 func restartDownload(Hash string) {
 	file, err := dbGetFile(Hash)
 	if err != nil {
@@ -244,27 +329,9 @@ func restartDownload(Hash string) {
 		return
 	}
 
-	//Get missing chunk indices
-	var missingChunks []int
-	for i := 0; i < file.NumChunks; i++ {
-		if !bitmap.Get(file.ChunkMap, i) {
-			missingChunks = append(missingChunks, i)
-		}
-	}
-
-	numChunks := len(missingChunks)
-
-	//Nothing more to download
-	if numChunks == 0 {
-		return
-	}
-
-	rand.Seed(time.Now().UnixNano())
-	//rand.Shuffle(numChunks, func(i, j int) { missingChunks[i], missingChunks[j] = missingChunks[j], missingChunks[i] })
-
 	log.Println("Restarting Download for", file.FileName)
 
-	downloadChunks(file, missingChunks)
+	queueDownload(Hash)
 }
 
 // fetches the number of clients connected and stores it
@@ -278,14 +345,14 @@ func updateNumClientStore() {
 // listens for incoming sessions
 func listenForIncomingSessions() {
 
-	for !client.IsClosed() {
-		listenSession, err := client.Accept()
+	for !sessionTransport.IsClosed() {
+		listenSession, err := sessionTransport.Accept()
 		if err != nil {
 			pushError("Error on client accept", err.Error())
 			continue
 		}
 
-		sessionmanager.AcceptSession(listenSession)
+		go sessionmanager.AcceptSession(listenSession)
 	}
 }
 
@@ -299,6 +366,10 @@ func onClientConnected(session *sessionmanager.Session, isDialIn bool) {
 	addr := session.Session.RemoteAddr().String()
 
 	log.Println("Client Connected", addr)
+	resetPeerHintRetries(addr)
+
+	//Tell the peer which protocol and features we speak before anything else
+	SendHello(session)
 
 	go listenToSession(session)
 }
@@ -306,22 +377,12 @@ func onClientConnected(session *sessionmanager.Session, isDialIn bool) {
 func onClientDisconnected(addr string) {
 	go updateNumClientStore()
 
-	mutexes.ListedFilesLock.Lock()
-	defer mutexes.ListedFilesLock.Unlock()
-
 	RemoveSeeder(addr)
+	removePeerHello(addr)
+	removeUploadPeer(addr)
 	log.Println("Client Disconnected", addr)
 
-	//Remove empty seeders listings
-	for i := 0; i < len(ListedFiles); i++ {
-		if !AnySeeders(ListedFiles[i].FileHash) {
-			// Remove the element at index i from a.
-			ListedFiles[i] = ListedFiles[len(ListedFiles)-1] // Copy last element to index i.
-			ListedFiles[len(ListedFiles)-1] = models.File{}  // Erase last element (write zero value).
-			ListedFiles = ListedFiles[:len(ListedFiles)-1]   // Truncate slice.
-			i--
-		}
-	}
+	removeUnseededListings()
 }
 
 func listenToSession(Session *sessionmanager.Session) {
@@ -344,6 +405,21 @@ func listenToSession(Session *sessionmanager.Session) {
 		case constants.SurgeChunkID:
 			//Write add to download internally after parsing data
 			go processChunk(Session, data)
+		case constants.SurgeChunkHashesID:
+			go processChunkHashes(Session, data)
+		case constants.SurgeChunkMapID:
+			go processChunkMap(Session, data)
+		case constants.SurgeBundleManifestID:
+			go processBundleManifest(Session, data)
+		case constants.SurgeChunkRejectID, constants.SurgeChunkBusyID:
+			go processChunkRefusal(Session, data, chunkType)
+		case constants.SurgeChunkCancelID:
+			go processChunkCancel(Session, data)
+		case constants.SurgeHelloID:
+			go processHello(Session, data)
+		default:
+			//Frames of newer protocol versions are skipped
+			log.Println("Unknown frame", chunkType, "from", addr, "skipped")
 		}
 	}
 }
@@ -353,34 +429,59 @@ func processChunk(Session *sessionmanager.Session, Data []byte) {
 	//Try to parse SurgeMessage
 	surgeMessage := &pb.SurgeMessage{}
 	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
-		log.Panic("Failed to parse surge message:", err)
+		log.Println("Failed to parse surge message from", Session.Session.RemoteAddr().String(), err)
+		return
 	}
 
 	//Write add to download
 	mutexes.BandwidthAccumulatorMapLock.Lock()
 	downloadBandwidthAccumulator[surgeMessage.FileID] += len(Data)
 	mutexes.BandwidthAccumulatorMapLock.Unlock()
+	atomic.AddInt64(&metricBytesDownloaded, int64(len(Data)))
 
 	//Data nill means its a request for data
 	if surgeMessage.Data == nil {
-		TransmitChunk(Session, surgeMessage.FileID, surgeMessage.ChunkID)
+		queueUpload(Session, surgeMessage.FileID, surgeMessage.ChunkID)
 	} else { //If data is not nill we are receiving data
 
+		//Verify the chunk before we accept it, corrupt chunks are rejected so they get requeued
+		isValid := verifyChunk(surgeMessage.FileID, surgeMessage.ChunkID, surgeMessage.Data)
+		if !isValid {
+			log.Println("Chunk", surgeMessage.ChunkID, "of", surgeMessage.FileID, "failed verification, received from", Session.Session.RemoteAddr().String())
+			recordChunkHashFailure(surgeMessage.FileID, Session.Session.RemoteAddr().String())
+		}
+
 		//When we receive a chunk mark it as no longer in transit
 		chunkKey := surgeMessage.FileID + "_" + strconv.Itoa(int(surgeMessage.ChunkID))
 
 		mutexes.ChunkInTransitLock.Lock()
 		chunksInTransit[chunkKey] = false
+		chunksRejected[chunkKey] = !isValid
+		requestTime, requested := chunkRequestTimes[chunkKey]
+		delete(chunkRequestTimes, chunkKey)
 		mutexes.ChunkInTransitLock.Unlock()
 
 		mutexes.WorkerMapLock.Lock()
+		inFlight := workerMap[Session.Session.RemoteAddr().String()]
 		workerMap[Session.Session.RemoteAddr().String()]--
 		if workerMap[Session.Session.RemoteAddr().String()] < 0 {
 			workerMap[Session.Session.RemoteAddr().String()] = 0
 		}
 		mutexes.WorkerMapLock.Unlock()
 
-		WriteChunk(surgeMessage.FileID, surgeMessage.ChunkID, surgeMessage.Data)
+		//Measure the seeder, corrupt chunks count against it once the request job picks up the rejection
+		if isValid {
+			atomic.AddInt64(&metricChunksReceived, 1)
+		} else {
+			atomic.AddInt64(&metricChunksCorrupt, 1)
+		}
+		if requested && isValid {
+			recordSeederChunk(Session.Session.RemoteAddr().String(), len(surgeMessage.Data), time.Since(requestTime), inFlight)
+		}
+
+		if isValid {
+			WriteChunk(surgeMessage.FileID, surgeMessage.ChunkID, surgeMessage.Data)
+		}
 	}
 }
 
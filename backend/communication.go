@@ -1,14 +1,21 @@
 package surge
 
 import (
-	"strconv"
+	"log"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/rule110-io/surge/backend/catalog"
 	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/magnet"
 	"github.com/rule110-io/surge/backend/messaging"
 	"github.com/rule110-io/surge/backend/models"
-	"github.com/rule110-io/surge/backend/mutexes"
+	pb "github.com/rule110-io/surge/backend/payloads"
+	"github.com/rule110-io/surge/backend/search"
 	"github.com/rule110-io/surge/backend/sessionmanager"
+	"google.golang.org/protobuf/proto"
 )
 
 const (
@@ -17,9 +24,17 @@ const (
 	MessageIDAnnounceNewFile
 	MessageIDAnnounceRemoveFile
 	MessageIDAnnounceDisconnect
+	MessageIDSearchQuery
+	MessageIDSearchResults
 )
 
 func MessageReceived(msg *messaging.MessageReceivedObj) {
+	//Peers are known by their nkn address, sessions with peers on another transport are dialed on the address they announce
+	//the transport handshake checks the address belongs to the sender before a session is used
+	if len(msg.SessionAddress) > 0 {
+		sessionmanager.SetPeerAddress(msg.Sender, msg.SessionAddress)
+	}
+
 	switch msg.Type {
 	case MessageIDAnnounceFiles:
 		if msg.Sender != GetAccountAddress() {
@@ -34,6 +49,12 @@ func MessageReceived(msg *messaging.MessageReceivedObj) {
 		go processRemoveFile(string(msg.Data), msg.Sender)
 	case MessageIDAnnounceDisconnect:
 		go sessionmanager.CloseSession(msg.Sender)
+	case MessageIDSearchQuery:
+		if msg.Sender != GetAccountAddress() {
+			go processSearchQuery(msg)
+		}
+	case MessageIDSearchResults:
+		go processQueryResponse(msg.Sender, msg.Data)
 	}
 }
 
@@ -63,6 +84,22 @@ func SendAnnounceFilesReply(msg *messaging.MessageReceivedObj) {
 	}
 }
 
+//AnnounceRefreshFiles announces our files on a topic again so their listings do not expire, without asking for replies
+func AnnounceRefreshFiles(topicEncoded string) {
+	payload := getTopicPayload(topicEncoded)
+	if len(payload) == 0 {
+		return
+	}
+
+	dataObj := messaging.MessageObj{
+		Type:         MessageIDAnnounceNewFile,
+		TopicEncoded: topicEncoded,
+		Data:         []byte(payload),
+	}
+
+	messaging.Broadcast(&dataObj)
+}
+
 func AnnounceNewFile(file *models.File) {
 	//Create payload
 	payload := surgeGenerateTopicPayload(file.FileName, file.FileSize, file.FileHash, file.Topic)
@@ -77,6 +114,34 @@ func AnnounceNewFile(file *models.File) {
 	messaging.Broadcast(&dataObj)
 }
 
+func AnnouncePartialFile(file *models.File) {
+	//Create payload
+	payload := surgeGeneratePartialTopicPayload(file.FileName, file.FileSize, file.FileHash, file.Topic)
+
+	//Create the data object
+	dataObj := messaging.MessageObj{
+		Type:         MessageIDAnnounceNewFile,
+		TopicEncoded: TopicEncode(file.Topic),
+		Data:         []byte(payload),
+	}
+
+	messaging.Broadcast(&dataObj)
+}
+
+func AnnounceNewBundle(bundle *models.Bundle, manifest *models.BundleManifest) {
+	//Create payload
+	payload := surgeGenerateBundleTopicPayload(manifest.Name, bundleSize(manifest), bundle.BundleHash, bundle.Topic)
+
+	//Create the data object
+	dataObj := messaging.MessageObj{
+		Type:         MessageIDAnnounceNewFile,
+		TopicEncoded: TopicEncode(bundle.Topic),
+		Data:         []byte(payload),
+	}
+
+	messaging.Broadcast(&dataObj)
+}
+
 func AnnounceRemoveFile(topic string, fileHash string) {
 	//Create the data object
 	dataObj := messaging.MessageObj{
@@ -88,6 +153,60 @@ func AnnounceRemoveFile(topic string, fileHash string) {
 	messaging.Broadcast(&dataObj)
 }
 
+//BroadcastSearchQuery asks the peers of a topic for their files matching the query, they reply with the matches directly
+//the results are listed like announced files
+func BroadcastSearchQuery(topic string, query string) bool {
+	if search.Parse(query).IsEmpty() {
+		pushError("Error on search query", "query without words")
+		return false
+	}
+
+	payload, err := proto.Marshal(&pb.SurgeQuery{Query: query})
+	if err != nil {
+		pushError("Error on search query", err.Error())
+		return false
+	}
+
+	dataObj := messaging.MessageObj{
+		Type:         MessageIDSearchQuery,
+		TopicEncoded: TopicEncode(topic),
+		Data:         payload,
+	}
+
+	messaging.Broadcast(&dataObj)
+	return true
+}
+
+// replies to a search query with the best matching files we list in the topic
+func processSearchQuery(msg *messaging.MessageReceivedObj) {
+	surgeQuery := &pb.SurgeQuery{}
+	if err := proto.Unmarshal(msg.Data, surgeQuery); err != nil {
+		log.Println("Failed to parse search query from", msg.Sender, err)
+		return
+	}
+
+	//Queries without words would ask for our whole catalog, that is what announcements are for
+	query := search.Parse(surgeQuery.Query)
+	if query.IsEmpty() || len(surgeQuery.Query) > constants.SearchQueryMaxLength {
+		return
+	}
+
+	links := getTopicLinks(msg.TopicEncoded, query)
+	if len(links) == 0 {
+		return
+	}
+	if len(links) > constants.SearchQueryMaxResults {
+		links = links[:constants.SearchQueryMaxResults]
+	}
+
+	dataObj := messaging.MessageObj{
+		Type:         MessageIDSearchResults,
+		TopicEncoded: msg.TopicEncoded,
+		Data:         []byte(strings.Join(links, "\n")),
+	}
+	msg.Reply(&dataObj)
+}
+
 func AnnounceDisconnect(topic string) {
 	//Create the data object
 	dataObj := messaging.MessageObj{
@@ -100,83 +219,130 @@ func AnnounceDisconnect(topic string) {
 
 func processRemoveFile(hash string, seeder string) {
 	RemoveFileSeeder(hash, seeder)
+	removeBundleSeeder(hash, seeder)
+
+	removeUnseededListings()
+}
+
+// removes the listings no seeder is left for
+func removeUnseededListings() {
+	ListedFiles.RemoveWhere(func(listing catalog.Listing) bool {
+		return !AnySeeders(listing.File.FileHash)
+	})
+}
+
+// removes the listings that were not announced within the listing ttl, listings with a connected seeder are kept
+func expireListings() {
+	expireBefore := time.Now().Unix() - constants.ListingTTL
+	expired := ListedFiles.RemoveWhere(func(listing catalog.Listing) bool {
+		return listing.LastSeen < expireBefore && !hasConnectedSeeder(listing.File.FileHash)
+	})
+
+	//Forget the seeders that stopped announcing
+	for _, listing := range expired {
+		log.Println("Listing expired", listing.File.FileName, listing.File.FileHash)
+		for _, seeder := range GetSeeders(listing.File.FileHash) {
+			RemoveFileSeeder(listing.File.FileHash, seeder)
+			removeBundleSeeder(listing.File.FileHash, seeder)
+		}
+	}
+}
 
-	mutexes.ListedFilesLock.Lock()
-	defer mutexes.ListedFilesLock.Unlock()
-
-	//Remove empty seeders listings
-	for i := 0; i < len(ListedFiles); i++ {
-		if !AnySeeders(ListedFiles[i].FileHash) {
-			// Remove the element at index i from a.
-			ListedFiles[i] = ListedFiles[len(ListedFiles)-1] // Copy last element to index i.
-			ListedFiles[len(ListedFiles)-1] = models.File{}  // Erase last element (write zero value).
-			ListedFiles = ListedFiles[:len(ListedFiles)-1]   // Truncate slice.
-			i--
+// returns whether we have a session with any seeder of a file
+func hasConnectedSeeder(fileHash string) bool {
+	for _, seeder := range GetSeeders(fileHash) {
+		if sessionmanager.IsExistingSession(seeder) {
+			return true
 		}
 	}
+	return false
 }
 
 func processQueryResponse(seeder string, Data []byte) {
 
-	//Try to parse SurgeMessage
-	s := string(Data)
-	mutexes.ListedFilesLock.Lock()
+	//Parse the response, a malformed link does not stop us from taking the others
+	links, errs := magnet.ParseAll(string(Data))
+	for _, err := range errs {
+		log.Println("Invalid listing from", seeder, err)
+	}
 
-	//Parse the response
-	payloadSplit := strings.Split(s, "surge://")
-	for j := 0; j < len(payloadSplit); j++ {
-		data := strings.Split(payloadSplit[j], "|")
+	for _, link := range links {
+		newListing := linkToListing(link)
 
-		if len(data) < 3 {
-			continue
+		//Add unique listings, refresh existing ones
+		if ListedFiles.Add(newListing) {
+			emitFileEvent(events.NewListing, &newListing, "")
 		}
 
-		fileSize, _ := strconv.ParseInt(data[3], 10, 64)
-		numChunks := int((fileSize-1)/int64(constants.ChunkSize)) + 1
-
-		newListing := models.File{
-			FileName:  data[2],
-			FileSize:  fileSize,
-			FileHash:  data[4],
-			Path:      "",
-			NumChunks: numChunks,
-			ChunkMap:  nil,
-			Topic:     data[5],
+		//We now add this seeder to our file seeders, partial seeders only serve the chunks in their chunk map
+		AddFileSeeder(newListing.FileHash, seeder)
+		if newListing.IsBundle {
+			addBundleSeeder(newListing.FileHash, seeder)
 		}
-
-		//Replace existing, or remove.
-		var replace = false
-		for l := 0; l < len(ListedFiles); l++ {
-			if ListedFiles[l].FileHash == newListing.FileHash {
-				replace = true
-				break
+		if link.Kind == magnet.KindPartial {
+			if !IsPartialSeeder(newListing.FileHash, seeder) {
+				SetPartialSeeder(newListing.FileHash, seeder, nil)
 			}
+		} else {
+			SetFullSeeder(newListing.FileHash, seeder)
 		}
-		//Unique listing so we add
-		if !replace {
-			ListedFiles = append(ListedFiles, newListing)
-		}
-
-		//We now add this seeder to our file seeders
-		AddFileSeeder(newListing.FileHash, seeder)
 	}
-	mutexes.ListedFilesLock.Unlock()
 }
 
 func getTopicPayload(topicEncoded string) string {
-	dbFiles := dbGetAllFiles()
+	//One link per line
+	return strings.Join(getTopicLinks(topicEncoded, search.Parse("")), "\n")
+}
 
-	payload := ""
-	for _, dbFile := range dbFiles {
+// returns the links of the files and bundles we list in a topic that match a query, best matches first
+func getTopicLinks(topicEncoded string, query search.Query) []string {
+	type topicLink struct {
+		link      string
+		relevance float64
+	}
+	matches := []topicLink{}
+	addMatch := func(name string, hash string, link string) {
+		if relevance, isMatch := query.Match(name, hash); isMatch {
+			matches = append(matches, topicLink{link, relevance})
+		}
+	}
 
+	for _, dbFile := range dbGetAllFiles() {
 		if TopicEncode(dbFile.Topic) != topicEncoded {
 			continue
 		}
 
+		//Files of a bundle are listed as part of the bundle
+		if len(dbFile.BundleHash) > 0 {
+			continue
+		}
+
 		if dbFile.IsUploading {
-			//Add to payload
-			payload += surgeGenerateTopicPayload(dbFile.FileName, dbFile.FileSize, dbFile.FileHash, dbFile.Topic)
+			addMatch(dbFile.FileName, dbFile.FileHash, surgeGenerateTopicPayload(dbFile.FileName, dbFile.FileSize, dbFile.FileHash, dbFile.Topic))
+		} else if dbFile.IsDownloading && !dbFile.IsPaused {
+			//Downloads serve the chunks they already have
+			addMatch(dbFile.FileName, dbFile.FileHash, surgeGeneratePartialTopicPayload(dbFile.FileName, dbFile.FileSize, dbFile.FileHash, dbFile.Topic))
 		}
 	}
-	return payload
+
+	//Add bundles of which we seed all files
+	for _, bundle := range dbGetAllBundles() {
+		if TopicEncode(bundle.Topic) != topicEncoded {
+			continue
+		}
+
+		manifest, err := parseBundleManifest(bundle.Manifest)
+		if err == nil && isBundleSeeding(manifest) {
+			addMatch(manifest.Name, bundle.BundleHash, surgeGenerateBundleTopicPayload(manifest.Name, bundleSize(manifest), bundle.BundleHash, bundle.Topic))
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].relevance > matches[j].relevance
+	})
+	links := []string{}
+	for _, match := range matches {
+		links = append(links, match.link)
+	}
+	return links
 }
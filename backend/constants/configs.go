@@ -10,6 +10,9 @@
 package constants
 
 const (
+	//ClientVersion is the version of this surge build, sent to peers in the hello
+	ClientVersion = "1.1.1"
+
 	//ChunkSize is size of chunk in bytes (1024 kB)
 	ChunkSize = 1024 * 1024
 
@@ -18,11 +21,64 @@ const (
 	NumClientsMin = 1
 	NumClientsMax = 8
 
-	//NumWorkers is the total number of concurrent chunk fetches allowed
+	//NumWorkers is the upper bound of concurrent chunk fetches per seeder, the actual number adapts to the seeder
 	NumWorkers    = 8
 	NumWorkersMin = 1
 	NumWorkersMax = 12
 
+	//UploadSlots is the number of chunks transmitted at once, also the number of peers unchoked at once
+	UploadSlots    = 8
+	UploadSlotsMin = 1
+	UploadSlotsMax = 32
+
+	//UploadQueueSize is the number of chunk requests queued for a slot, requests beyond it are answered busy
+	UploadQueueSize = 256
+
+	//UploadPeerQueueSize is the number of chunk requests queued per peer
+	UploadPeerQueueSize = 32
+
+	//UploadRechokeInterval is the interval in seconds at which the longest unchoked peer makes room for a waiting one
+	UploadRechokeInterval = 10
+
+	//FileStateFlushInterval is the interval in seconds at which cached chunk maps and share counts are stored in the db
+	FileStateFlushInterval = 5
+
+	//MaxActiveDownloads is the number of downloads transferring at once, others wait in the queue
+	MaxActiveDownloads    = 3
+	MaxActiveDownloadsMin = 1
+	MaxActiveDownloadsMax = 20
+
+	//Download priorities decide where a download is placed in the queue
+	DownloadPriorityHigh    = "high"
+	DownloadPriorityNormal  = "normal"
+	DownloadPriorityLow     = "low"
+	DownloadPriorityDefault = DownloadPriorityNormal
+
+	//Chunk strategies decide the order in which chunks of a file are downloaded
+	ChunkStrategySequential  = "sequential"
+	ChunkStrategyRandom      = "random"
+	ChunkStrategyRarestFirst = "rarest"
+	ChunkStrategyDefault     = ChunkStrategySequential
+
+	//Hook types, exec runs an executable and webhook posts to an url
+	HookTypeExec    = "exec"
+	HookTypeWebhook = "webhook"
+
+	//HookAttempts is the number of times a failing hook is run before it is given up
+	HookAttempts = 3
+
+	//HookRetryDelay is the delay in seconds before a failed hook is retried, doubled on every retry
+	HookRetryDelay = 2
+
+	//HookTimeout is the time in seconds a hook may take per attempt
+	HookTimeout = 30
+
+	//HookLogSize is the number of hook executions kept in the hook log
+	HookLogSize = 200
+
+	//HookOutputLimit is the number of bytes of hook output kept in the hook log
+	HookOutputLimit = 1024
+
 	//duration of a subscription blocktime is ~20sec
 	SubscriptionDuration = 4000
 
@@ -16,18 +16,129 @@ const (
 	//SurgeChunkID .
 	SurgeChunkID byte = 0x001
 
+	//SurgeChunkHashesID requests or transmits the per chunk hashes of a file
+	SurgeChunkHashesID byte = 0x002
+
+	//SurgeChunkMapID requests or transmits the chunk map of a file, used for swarming with partial seeders
+	SurgeChunkMapID byte = 0x003
+
+	//SurgeBundleManifestID requests or transmits the file manifest of a seeded directory
+	SurgeBundleManifestID byte = 0x004
+
+	//SurgeChunkRejectID tells a downloader a requested chunk will not be served, the data holds the reason
+	SurgeChunkRejectID byte = 0x005
+
+	//SurgeChunkBusyID tells a downloader the seeder has no room for the request right now
+	SurgeChunkBusyID byte = 0x006
+
+	//SurgeChunkCancelID tells a seeder a requested chunk is no longer needed
+	SurgeChunkCancelID byte = 0x007
+
+	//SurgeHelloID is sent by both peers when a session opens, it carries the protocol version and features
+	SurgeHelloID byte = 0x008
+
+	//ProtocolVersion is the version of the session protocol we speak
+	ProtocolVersion = 2
+
+	//LegacyProtocolVersion is the version of peers that do not send a hello
+	LegacyProtocolVersion = 1
+
+	//MinProtocolVersion is the oldest protocol version we keep sessions with
+	MinProtocolVersion = 1
+
+	//HelloReceiveTimeout is the time we wait for the hello of a new session before treating the peer as version 1
+	HelloReceiveTimeout = 5 //seconds
+
+	//Features announced in the hello
+	FeatureChunkHashes  = "chunk-hashes"
+	FeaturePartialSeeds = "partial-seeding"
+	FeatureBundles      = "bundles"
+	FeatureChunkReplies = "chunk-replies"
+
+	//Reasons sent with a chunk reject
+	ChunkRejectNotSeeded    = "not seeded"
+	ChunkRejectNotAvailable = "not available"
+	ChunkRejectReadError    = "read error"
+
 	//NknClientDialTimeout time before timeout error on dial with nkn client
 	NknClientDialTimeout = 10000
 
 	//WorkerChunkReceiveTimeout is the time till a chunk request is considered a timeout and the chunk is requeued
 	WorkerChunkReceiveTimeout = 120 //seconds
 
+	//ChunkHashesReceiveTimeout is the time a download waits for chunk hashes before it continues without them
+	ChunkHashesReceiveTimeout = 10 //seconds
+
+	//ChunkHashesQuorum is the number of seeders that have to offer the same chunk hashes before they are used
+	ChunkHashesQuorum = 2
+
+	//ChunkHashesDistrustSeeders is the number of seeders whose chunks fail verification before the chunk hashes are dropped
+	ChunkHashesDistrustSeeders = 2
+
+	//SeederBackoffBase is the time a seeder is skipped after a failed chunk request, doubled on every failure in a row up to SeederBackoffMax
+	SeederBackoffBase = 5   //seconds
+	SeederBackoffMax  = 120 //seconds
+
+	//SeederBusyBackoff is the time a seeder that answered busy is skipped, and a chunk it refused waits before it is requested again
+	SeederBusyBackoff = 2 //seconds
+
+	//SeederWindowInitial is the number of chunks requested at once from a seeder we have not measured yet
+	SeederWindowInitial = 2
+
+	//SeederWindowGain is the factor by which the goodput of a seeder has to improve with every chunk its window grew by
+	SeederWindowGain = 1.05
+
+	//SeederStatsSmoothing is the weight of a new measurement in the smoothed round trip and throughput of a seeder
+	SeederStatsSmoothing = 0.3
+
+	//ListingAnnounceInterval is the interval at which our files are announced again so their listings stay fresh
+	ListingAnnounceInterval = 900 //seconds
+
+	//ListingTTL is the time after which a remote listing that was not announced again expires
+	ListingTTL = 3600 //seconds
+
+	//SearchQueryMaxResults is the number of matching files we reply to a search query with, the best matches are sent
+	SearchQueryMaxResults = 50
+
+	//SearchQueryMaxLength is the length of the longest search query we answer
+	SearchQueryMaxLength = 256
+
+	//PeerHintRetryDelay is the time before a peer hint that did not open a session is added as seeder again, doubled on every attempt
+	PeerHintRetryDelay = 5 //seconds
+
+	//PeerHintAttempts is the number of times a peer hint is added as seeder without opening a session before it is dropped
+	PeerHintAttempts = 6
+
+	//ChunkMapRefreshInterval is the interval at which chunk maps of partial seeders are refreshed during a download
+	ChunkMapRefreshInterval = 10 //seconds
+
+	//BundleManifestReceiveTimeout is the time a bundle download waits for the manifest from its seeders
+	BundleManifestReceiveTimeout = 30 //seconds
+
 	//WorkerGetSessionTimeout when the session activity is older than this value the worker considers the session lost and moves on
 	WorkerGetSessionTimeout = 60 //seconds
 
 	//GetSessionDialTimeout time till dial timeout
 	GetSessionDialTimeout = 60
 
+	//SessionTransportTCP is the sessionTransport setting value to carry sessions over plain tcp instead of nkn
+	SessionTransportTCP = "tcp"
+
+	//DefaultTCPTransportAddr listen address for the tcp session transport when none is configured
+	DefaultTCPTransportAddr = "127.0.0.1:7420"
+
+	//DefaultAPIAddr listen address for the local control api when none is configured
+	DefaultAPIAddr = "127.0.0.1:7421"
+
+	//DefaultMetricsAddr listen address for the metrics endpoint when none is configured
+	DefaultMetricsAddr = "127.0.0.1:7422"
+
+	//APITokenFile name of the file in the surge dir holding the local control api token
+	APITokenFile = "api.token"
+
+	//HooksFile name of the file in the surge dir holding the event hooks
+	HooksFile = "hooks.json"
+
 	//DefaultRPCAddress default RPC endpoint if no bootstrap is available
 	DefaultRPCAddress = "http://seed.nkn.org:30003"
 )
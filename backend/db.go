@@ -12,6 +12,7 @@ package surge
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -19,14 +20,16 @@ import (
 	"log"
 
 	"github.com/rule110-io/surge/backend/models"
-	"github.com/rule110-io/surge/backend/mutexes"
 	"github.com/rule110-io/surge/backend/platform"
+	"github.com/rule110-io/surge/backend/search"
 
 	"github.com/xujiajun/nutsdb"
 )
 
 const fileBucketName = "fileBucket"
 const settingBucketName = "settingsBucket"
+const chunkHashBucketName = "chunkHashBucket"
+const bundleBucketName = "bundleBucket"
 
 var db *nutsdb.DB
 
@@ -57,10 +60,13 @@ func CloseDb() {
 	db.Close()
 }
 
-// Gets all Files in the DB
+// Gets all Files in the DB, cached files include their unflushed changes
 func dbGetAllFiles() []models.File {
 	files := []models.File{}
 
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
 	if err := db.View(
 		func(tx *nutsdb.Tx) error {
 			entries, err := tx.GetAll(fileBucketName)
@@ -72,6 +78,9 @@ func dbGetAllFiles() []models.File {
 
 				newFile := &models.File{}
 				json.Unmarshal(entry.Value, newFile)
+				if cachedFile, exists := fileStates[newFile.FileHash]; exists {
+					newFile = cloneFile(cachedFile)
+				}
 				files = append(files, *newFile)
 			}
 
@@ -86,23 +95,14 @@ func dbGetAllFiles() []models.File {
 
 // Gets a File by providing the fileHash
 func dbGetFile(Hash string) (*models.File, error) {
-	result := &models.File{}
-
-	if err := db.View(
-		func(tx *nutsdb.Tx) error {
-			fileKey := []byte(Hash)
-			e, err := tx.Get(fileBucketName, fileKey)
-			if err != nil {
-				return err
-			}
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
 
-			err = json.Unmarshal(e.Value, result)
-			return err
-		}); err != nil {
+	file, err := getFileState(Hash)
+	if err != nil {
 		return nil, err
 	}
-
-	return result, nil
+	return cloneFile(file), nil
 }
 
 // Inserts a File to the DB
@@ -112,6 +112,18 @@ func dbInsertFile(File models.File) {
 		File.DateTimeAdded = time.Now().Unix()
 	}
 
+	//The chunk map may hold chunks not synced to disk yet, they were written before it was read so syncing now covers them
+	//the sync happens before taking the lock, reads of other files do not wait for the disk
+	fileStateLock.Lock()
+	isDirty := dirtyFileStates[File.FileHash]
+	fileStateLock.Unlock()
+	if isDirty {
+		syncFileData(&File)
+	}
+
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
 	if err := db.Update(
 		func(tx *nutsdb.Tx) error {
 
@@ -125,10 +137,18 @@ func dbInsertFile(File models.File) {
 		}); err != nil {
 		log.Panic(err)
 	}
+
+	fileStates[File.FileHash] = cloneFile(&File)
+	delete(dirtyFileStates, File.FileHash)
 }
 
 // Deletes a File by providing the fileHash
 func dbDeleteFile(Hash string) error {
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
+	removeFileState(Hash)
+
 	if err := db.Update(
 		func(tx *nutsdb.Tx) error {
 			key := []byte(Hash)
@@ -143,6 +163,110 @@ func dbDeleteFile(Hash string) error {
 	return nil
 }
 
+// Gets the concatenated chunk hashes of a File by providing the fileHash
+func dbGetChunkHashes(Hash string) ([]byte, error) {
+	var result []byte
+
+	if err := db.View(
+		func(tx *nutsdb.Tx) error {
+			e, err := tx.Get(chunkHashBucketName, []byte(Hash))
+			if err != nil {
+				return err
+			}
+
+			result = e.Value
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Inserts the concatenated chunk hashes of a File to the DB
+func dbInsertChunkHashes(Hash string, ChunkHashes []byte) {
+	if err := db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Put(chunkHashBucketName, []byte(Hash), ChunkHashes, 0)
+		}); err != nil {
+		log.Println("Db insert chunk hashes", err)
+	}
+}
+
+// Deletes the chunk hashes of a File by providing the fileHash
+func dbDeleteChunkHashes(Hash string) error {
+	if err := db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Delete(chunkHashBucketName, []byte(Hash))
+		}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Gets all Bundles in the DB
+func dbGetAllBundles() []models.Bundle {
+	bundles := []models.Bundle{}
+
+	if err := db.View(
+		func(tx *nutsdb.Tx) error {
+			entries, err := tx.GetAll(bundleBucketName)
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				bundle := models.Bundle{}
+				json.Unmarshal(entry.Value, &bundle)
+				bundles = append(bundles, bundle)
+			}
+			return nil
+		}); err != nil {
+		return bundles
+	}
+	return bundles
+}
+
+// Gets a Bundle by providing the bundleHash
+func dbGetBundle(Hash string) (*models.Bundle, error) {
+	result := &models.Bundle{}
+
+	if err := db.View(
+		func(tx *nutsdb.Tx) error {
+			e, err := tx.Get(bundleBucketName, []byte(Hash))
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(e.Value, result)
+		}); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Inserts a Bundle to the DB
+func dbInsertBundle(Bundle models.Bundle) {
+	if err := db.Update(
+		func(tx *nutsdb.Tx) error {
+			bundleBytes, _ := json.Marshal(Bundle)
+			return tx.Put(bundleBucketName, []byte(Bundle.BundleHash), bundleBytes, 0)
+		}); err != nil {
+		log.Println("Db insert bundle", err)
+	}
+}
+
+// Deletes a Bundle by providing the bundleHash
+func dbDeleteBundle(Hash string) error {
+	if err := db.Update(
+		func(tx *nutsdb.Tx) error {
+			return tx.Delete(bundleBucketName, []byte(Hash))
+		}); err != nil {
+		return err
+	}
+	return nil
+}
+
 //DbWriteSetting Stores or updates a key with a given value
 func DbWriteSetting(Name string, value string) error {
 	err := db.Update(
@@ -193,52 +317,58 @@ type PagedQueryRemoteResult struct {
 	Count  int
 }
 
-//SearchRemoteFile runs a paged query
-func SearchRemoteFile(Topic string, Query string, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryRemoteResult {
+//SearchRemoteFile runs a paged query over the listings of a topic, or of all subscribed topics when Topic is empty
+func SearchRemoteFile(Topic string, Query string, Filter models.ListingFilter, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryRemoteResult {
 
 	var results []models.FileListing
 
-	mutexes.ListedFilesLock.Lock()
-	for _, file := range ListedFiles {
-
-		if file.Topic == Topic {
-
-			if strings.Contains(strings.ToLower(file.FileName), strings.ToLower(Query)) || strings.Contains(strings.ToLower(file.FileHash), strings.ToLower(Query)) {
-
-				localFile, _ := dbGetFile(file.FileHash)
-
-				if localFile != nil {
-					result := models.FileListing{
-						FileName:      file.FileName,
-						FileHash:      file.FileHash,
-						FileSize:      file.FileSize,
-						NumChunks:     file.NumChunks,
-						Topic:         file.Topic,
-						NumSeeders:    len(GetSeeders(file.FileHash)),
-						IsTracked:     true,
-						IsDownloading: file.IsDownloading,
-						IsUploading:   file.IsUploading,
-					}
-					results = append(results, result)
-				} else {
-					result := models.FileListing{
-						FileName:      file.FileName,
-						FileHash:      file.FileHash,
-						FileSize:      file.FileSize,
-						NumChunks:     file.NumChunks,
-						Topic:         file.Topic,
-						NumSeeders:    len(GetSeeders(file.FileHash)),
-						IsTracked:     false,
-						IsDownloading: file.IsDownloading,
-						IsUploading:   file.IsUploading,
-					}
-					results = append(results, result)
-				}
+	topics := []string{Topic}
+	if len(Topic) == 0 {
+		topics = getSubscribedTopicNames()
+	}
+
+	query := search.Parse(Query)
+	listed := map[string]bool{}
+	for _, topic := range topics {
+		for _, listing := range ListedFiles.Topic(topic) {
+			file := listing.File
+
+			//A file announced in several subscribed topics is found once
+			if listed[file.FileHash] {
+				continue
+			}
+			listed[file.FileHash] = true
 
+			relevance, matches := query.Match(file.FileName, file.FileHash)
+			if !matches {
+				continue
 			}
+
+			numSeeders := len(GetSeeders(file.FileHash))
+			if !matchesListingFilter(&file, numSeeders, Filter) {
+				continue
+			}
+
+			localFile, _ := dbGetFile(file.FileHash)
+
+			result := models.FileListing{
+				FileName:      file.FileName,
+				FileHash:      file.FileHash,
+				FileSize:      file.FileSize,
+				NumChunks:     file.NumChunks,
+				Topic:         file.Topic,
+				NumSeeders:    numSeeders,
+				IsTracked:     localFile != nil,
+				IsDownloading: file.IsDownloading,
+				IsUploading:   file.IsUploading,
+				IsBundle:      file.IsBundle,
+				FirstSeen:     listing.FirstSeen,
+				LastSeen:      listing.LastSeen,
+				Relevance:     relevance,
+			}
+			results = append(results, result)
 		}
 	}
-	mutexes.ListedFilesLock.Unlock()
 
 	switch OrderBy {
 	case "FileName":
@@ -253,6 +383,12 @@ func SearchRemoteFile(Topic string, Query string, OrderBy string, IsDesc bool, S
 		} else {
 			sort.Sort(sortByListingFileSizeDesc(results))
 		}
+	case "Relevance":
+		if !IsDesc {
+			sort.Sort(sortByListingRelevanceAsc(results))
+		} else {
+			sort.Sort(sortByListingRelevanceDesc(results))
+		}
 	default:
 		if !IsDesc {
 			sort.Sort(sortByListingSeederCountAsc(results))
@@ -278,6 +414,33 @@ func SearchRemoteFile(Topic string, Query string, OrderBy string, IsDesc bool, S
 	}
 }
 
+// returns whether a listing passes the filter
+func matchesListingFilter(file *models.File, numSeeders int, filter models.ListingFilter) bool {
+	if len(filter.Extensions) > 0 {
+		if file.IsBundle {
+			return false
+		}
+		extension := strings.TrimPrefix(strings.ToLower(filepath.Ext(file.FileName)), ".")
+		matches := false
+		for _, wanted := range filter.Extensions {
+			if strings.TrimPrefix(strings.ToLower(wanted), ".") == extension {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			return false
+		}
+	}
+	if file.FileSize < filter.MinSize {
+		return false
+	}
+	if filter.MaxSize > 0 && file.FileSize > filter.MaxSize {
+		return false
+	}
+	return numSeeders >= filter.MinSeeders
+}
+
 //SearchLocalFile runs a paged query
 func SearchLocalFile(Query string, filterState FileFilterState, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryResult {
 
@@ -0,0 +1,265 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the download queue
+	Downloads wait in the queue until one of the active download slots is free, a download is placed after
+	all queued downloads of equal or higher priority. The order is stored with the files so it survives a restart.
+*/
+
+package surge
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/mutexes"
+)
+
+//QueuedDownload describes a download that is active or waiting in the queue
+type QueuedDownload struct {
+	FileHash string
+	FileName string
+	Priority string
+	Position int //position in the queue, -1 for active downloads
+	IsActive bool
+}
+
+//hashes of downloads waiting for a slot, in order
+var downloadQueue = []string{}
+
+//hashes of downloads transferring
+var activeDownloads = map[string]bool{}
+var downloadQueueLock = sync.Mutex{}
+
+//IsValidDownloadPriority returns whether the priority is known
+func IsValidDownloadPriority(priority string) bool {
+	return priority == constants.DownloadPriorityHigh ||
+		priority == constants.DownloadPriorityNormal ||
+		priority == constants.DownloadPriorityLow
+}
+
+// lower ranks are downloaded first
+func priorityRank(priority string) int {
+	switch priority {
+	case constants.DownloadPriorityHigh:
+		return 0
+	case constants.DownloadPriorityLow:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// returns the priority of a download, normal when it has none
+func getDownloadPriority(hash string) string {
+	file, err := dbGetFile(hash)
+	if err != nil || !IsValidDownloadPriority(file.Priority) {
+		return constants.DownloadPriorityNormal
+	}
+	return file.Priority
+}
+
+// queues the unfinished downloads found on startup in their stored order
+func restoreDownloadQueue(files []models.File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].QueuePosition < files[j].QueuePosition
+	})
+
+	downloadQueueLock.Lock()
+	for _, file := range files {
+		if file.IsDownloading && !file.IsPaused {
+			downloadQueue = append(downloadQueue, file.FileHash)
+		}
+	}
+	downloadQueueLock.Unlock()
+
+	scheduleDownloads()
+}
+
+// adds a download to the queue after all downloads of equal or higher priority, false when it is queued or active already
+func queueDownload(hash string) bool {
+	priority := getDownloadPriority(hash)
+
+	downloadQueueLock.Lock()
+	if activeDownloads[hash] || containsString(downloadQueue, hash) {
+		downloadQueueLock.Unlock()
+		return false
+	}
+
+	index := len(downloadQueue)
+	for i, queuedHash := range downloadQueue {
+		if priorityRank(getDownloadPriority(queuedHash)) > priorityRank(priority) {
+			index = i
+			break
+		}
+	}
+	downloadQueue = insertString(downloadQueue, index, hash)
+	queue := append([]string{}, downloadQueue...)
+	downloadQueueLock.Unlock()
+
+	storeQueuePositions(queue)
+	scheduleDownloads()
+	return true
+}
+
+// removes a download from the queue, active downloads stop by themselves once paused or removed
+func removeQueuedDownload(hash string) {
+	downloadQueueLock.Lock()
+	defer downloadQueueLock.Unlock()
+
+	downloadQueue = removeStringFromSlice(downloadQueue, hash)
+}
+
+// starts queued downloads while there are free slots
+func scheduleDownloads() {
+	downloadQueueLock.Lock()
+	defer downloadQueueLock.Unlock()
+
+	for len(activeDownloads) < getMaxActiveDownloads() && len(downloadQueue) > 0 {
+		hash := downloadQueue[0]
+		downloadQueue = downloadQueue[1:]
+		activeDownloads[hash] = true
+		go startDownload(hash)
+	}
+}
+
+// frees the slot of a download that stopped, finished or not, and starts the next one
+func downloadFinished(hash string) {
+	downloadQueueLock.Lock()
+	delete(activeDownloads, hash)
+	downloadQueueLock.Unlock()
+
+	scheduleDownloads()
+}
+
+// starts transferring the missing chunks of a download
+func startDownload(hash string) {
+	file, err := dbGetFile(hash)
+	if err != nil || file.IsPaused || !file.IsDownloading {
+		downloadFinished(hash)
+		return
+	}
+
+	//Get missing chunk indices
+	var missingChunks []int
+	for i := 0; i < file.NumChunks; i++ {
+		if !bitmap.Get(file.ChunkMap, i) {
+			missingChunks = append(missingChunks, i)
+		}
+	}
+
+	//Nothing more to download
+	if len(missingChunks) == 0 {
+		downloadFinished(hash)
+		return
+	}
+
+	log.Println("Starting queued download for", file.FileName)
+	emitFileEvent(events.DownloadStarted, file, "")
+
+	downloadChunks(file, missingChunks)
+}
+
+// stores the queue order with the files
+func storeQueuePositions(queue []string) {
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+
+	for i, hash := range queue {
+		file, err := dbGetFile(hash)
+		if err != nil || file.QueuePosition == i {
+			continue
+		}
+		file.QueuePosition = i
+		dbInsertFile(*file)
+	}
+}
+
+//SetDownloadPriority sets the priority of a download, a queued download moves to its new place in the queue
+func SetDownloadPriority(Hash string, Priority string) bool {
+	if !IsValidDownloadPriority(Priority) {
+		pushError("Error on set priority", "unknown priority "+Priority)
+		return false
+	}
+
+	mutexes.FileWriteLock.Lock()
+	file, err := dbGetFile(Hash)
+	if err != nil {
+		mutexes.FileWriteLock.Unlock()
+		pushError("Error on set priority", err.Error())
+		return false
+	}
+	file.Priority = Priority
+	dbInsertFile(*file)
+	mutexes.FileWriteLock.Unlock()
+
+	//Requeue to take the place of the new priority
+	downloadQueueLock.Lock()
+	queued := containsString(downloadQueue, Hash)
+	downloadQueueLock.Unlock()
+	if queued {
+		removeQueuedDownload(Hash)
+		queueDownload(Hash)
+	}
+	return true
+}
+
+//MoveQueuedDownload moves a queued download to a position in the queue, 0 is next
+func MoveQueuedDownload(Hash string, Position int) bool {
+	downloadQueueLock.Lock()
+	if !containsString(downloadQueue, Hash) {
+		downloadQueueLock.Unlock()
+		pushError("Error on move download", "download is not queued")
+		return false
+	}
+
+	downloadQueue = removeStringFromSlice(downloadQueue, Hash)
+	downloadQueue = insertString(downloadQueue, clamp(Position, 0, len(downloadQueue)), Hash)
+	queue := append([]string{}, downloadQueue...)
+	downloadQueueLock.Unlock()
+
+	storeQueuePositions(queue)
+	return true
+}
+
+//GetDownloadQueue returns the active downloads followed by the queued downloads in order
+func GetDownloadQueue() []QueuedDownload {
+	downloadQueueLock.Lock()
+	active := []string{}
+	for hash := range activeDownloads {
+		active = append(active, hash)
+	}
+	queue := append([]string{}, downloadQueue...)
+	downloadQueueLock.Unlock()
+
+	sort.Strings(active)
+
+	result := []QueuedDownload{}
+	for i, hash := range append(active, queue...) {
+		file, err := dbGetFile(hash)
+		if err != nil {
+			continue
+		}
+
+		isActive := i < len(active)
+		position := -1
+		if !isActive {
+			position = i - len(active)
+		}
+		result = append(result, QueuedDownload{
+			FileHash: hash,
+			FileName: file.FileName,
+			Priority: getDownloadPriority(hash),
+			Position: position,
+			IsActive: isActive,
+		})
+	}
+	return result
+}
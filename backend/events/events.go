@@ -0,0 +1,255 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the event bus
+	Events are delivered to every subscriber in the order they were emitted. Each subscriber has its own queue
+	drained by its own goroutine so emitting never blocks, a subscriber that falls behind loses its oldest events.
+	Subscribers can start paused, events are queued until they are ready. Events emitted while no subscriber wanting them
+	is ready are kept and handed to the next subscriber that becomes ready, unless that subscriber queued them already.
+*/
+
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//Name identifies the kind of event
+type Name string
+
+//Events emitted by the backend
+const (
+	Notification    Name = "notificationEvent"
+	Error           Name = "errorEvent"
+	BandwidthUpdate Name = "globalBandwidthUpdate"
+	DarkTheme       Name = "darkThemeEvent"
+	TopicsUpdated   Name = "topicsUpdated"
+
+	//Lifecycle events, their data is a FileEvent or TopicEvent
+	DownloadStarted    Name = "downloadStarted"
+	DownloadFinished   Name = "downloadFinished"
+	VerificationFailed Name = "verificationFailed"
+	FileSeeded         Name = "fileSeeded"
+	NewListing         Name = "newListing"
+	TopicStateChanged  Name = "topicStateChanged"
+)
+
+//FileEvent is the data of file lifecycle events
+type FileEvent struct {
+	FileHash string
+	FileName string
+	FileSize int64
+	Path     string
+	Topic    string
+	Error    string `json:",omitempty"`
+}
+
+//TopicEvent is the data of topic events
+type TopicEvent struct {
+	Topic string
+	State int
+}
+
+//number of events queued per subscriber and kept while no subscriber is ready
+const queueSize = 1024
+
+//Event is an emitted event with its data
+type Event struct {
+	Name Name
+	Data []interface{}
+	Time int64 //unix seconds
+	seq  uint64
+}
+
+//Handler receives events
+type Handler func(event Event)
+
+//Subscription delivers events to a handler
+type Subscription struct {
+	bus     *Bus
+	handler Handler
+	names   map[Name]bool //events delivered, all when empty
+	queue   []Event
+	since   uint64 //sequence number of the first event emitted after subscribing
+	ready   bool
+	closed  bool
+	cond    *sync.Cond
+}
+
+//Bus delivers emitted events to its subscribers
+type Bus struct {
+	subscriptions []*Subscription
+	backlog       []Event
+	seq           uint64 //sequence number of the next event
+	lock          sync.Mutex
+}
+
+//NewBus creates a bus without subscribers
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+//Emit queues an event for every subscriber, it never blocks
+func (b *Bus) Emit(name Name, data ...interface{}) {
+	event := Event{
+		Name: name,
+		Data: data,
+		Time: time.Now().Unix(),
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	event.seq = b.seq
+	b.seq++
+
+	anyReady := false
+	for _, subscription := range b.subscriptions {
+		subscription.push(event)
+		anyReady = anyReady || (subscription.isReady() && subscription.wants(event))
+	}
+
+	if !anyReady {
+		b.backlog = appendBounded(b.backlog, event)
+	}
+}
+
+//Subscribe delivers events to the handler, only the given events when names are given
+func (b *Bus) Subscribe(handler Handler, names ...Name) *Subscription {
+	subscription := b.SubscribePaused(handler, names...)
+	subscription.SetReady()
+	return subscription
+}
+
+//SubscribePaused queues events for the handler until the subscription is set ready
+func (b *Bus) SubscribePaused(handler Handler, names ...Name) *Subscription {
+	subscription := &Subscription{
+		bus:     b,
+		handler: handler,
+		names:   map[Name]bool{},
+	}
+	subscription.cond = sync.NewCond(&sync.Mutex{})
+	for _, name := range names {
+		subscription.names[name] = true
+	}
+
+	b.lock.Lock()
+	subscription.since = b.seq
+	b.subscriptions = append(b.subscriptions, subscription)
+	b.lock.Unlock()
+
+	go subscription.deliver()
+	return subscription
+}
+
+//SetReady starts delivering queued events, the first subscription to become ready also receives the events emitted before
+func (s *Subscription) SetReady() {
+	s.bus.lock.Lock()
+	defer s.bus.lock.Unlock()
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	//Events emitted before subscribing precede those queued since, the later ones are queued already
+	//events the subscription does not want are kept for the next one
+	queue := []Event{}
+	backlog := []Event{}
+	for _, event := range s.bus.backlog {
+		if !s.wants(event) {
+			backlog = append(backlog, event)
+		} else if event.seq < s.since {
+			queue = append(queue, event)
+		}
+	}
+	s.bus.backlog = backlog
+	s.queue = append(queue, s.queue...)
+	s.ready = true
+	s.cond.Signal()
+}
+
+//Unsubscribe stops delivering events, queued events are dropped
+func (s *Subscription) Unsubscribe() {
+	s.bus.lock.Lock()
+	for i, subscription := range s.bus.subscriptions {
+		if subscription == s {
+			s.bus.subscriptions = append(s.bus.subscriptions[:i:i], s.bus.subscriptions[i+1:]...)
+			break
+		}
+	}
+	s.bus.lock.Unlock()
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	s.closed = true
+	s.queue = nil
+	s.cond.Signal()
+}
+
+func (s *Subscription) wants(event Event) bool {
+	return len(s.names) == 0 || s.names[event.Name]
+}
+
+func (s *Subscription) isReady() bool {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	return s.ready
+}
+
+// queues an event when the subscription wants it
+func (s *Subscription) push(event Event) {
+	if !s.wants(event) {
+		return
+	}
+
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.queue = appendBounded(s.queue, event)
+	s.cond.Signal()
+}
+
+// hands queued events to the handler one by one until unsubscribed
+func (s *Subscription) deliver() {
+	for {
+		s.cond.L.Lock()
+		for !s.closed && (!s.ready || len(s.queue) == 0) {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.cond.L.Unlock()
+			return
+		}
+		event := s.queue[0]
+		s.queue = s.queue[1:]
+		s.cond.L.Unlock()
+
+		s.handle(event)
+	}
+}
+
+// calls the handler, a panicking handler does not stop the delivery
+func (s *Subscription) handle(event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Event handler for", event.Name, "panicked:", r)
+		}
+	}()
+	s.handler(event)
+}
+
+// appends an event and drops the oldest when the queue is full
+func appendBounded(queue []Event, event Event) []Event {
+	if len(queue) >= queueSize {
+		queue = queue[1:]
+	}
+	return append(queue, event)
+}
@@ -0,0 +1,96 @@
+package events
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// collects the names of delivered events
+type recorder struct {
+	names []Name
+	lock  sync.Mutex
+}
+
+func (r *recorder) handle(event Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.names = append(r.names, event.Name)
+}
+
+// waits for deliveries to settle and returns the delivered names
+func (r *recorder) delivered() []Name {
+	time.Sleep(time.Millisecond * 50)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return append([]Name{}, r.names...)
+}
+
+func expectNames(t *testing.T, got []Name, want ...Name) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("delivered %d events %v, want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("delivered %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPausedSubscriptionReceivesEventsOnceWhenReady(t *testing.T) {
+	bus := NewBus()
+	r := &recorder{}
+	subscription := bus.SubscribePaused(r.handle)
+
+	bus.Emit(Notification)
+	expectNames(t, r.delivered())
+
+	subscription.SetReady()
+	expectNames(t, r.delivered(), Notification)
+}
+
+func TestBacklogPrecedesQueuedEvents(t *testing.T) {
+	bus := NewBus()
+	bus.Emit(Notification)
+
+	r := &recorder{}
+	subscription := bus.SubscribePaused(r.handle)
+	bus.Emit(Error)
+
+	subscription.SetReady()
+	expectNames(t, r.delivered(), Notification, Error)
+}
+
+func TestBacklogGoesToFirstReadySubscription(t *testing.T) {
+	bus := NewBus()
+	bus.Emit(Notification)
+
+	first := &recorder{}
+	bus.Subscribe(first.handle)
+	second := &recorder{}
+	bus.Subscribe(second.handle)
+
+	expectNames(t, first.delivered(), Notification)
+	expectNames(t, second.delivered())
+}
+
+func TestBacklogKeepsEventsNotWanted(t *testing.T) {
+	bus := NewBus()
+	bus.Emit(Notification)
+	bus.Emit(TopicsUpdated)
+
+	topics := &recorder{}
+	bus.Subscribe(topics.handle, TopicsUpdated)
+	frontend := &recorder{}
+	subscription := bus.SubscribePaused(frontend.handle)
+	bus.Emit(Error)
+	subscription.SetReady()
+
+	expectNames(t, topics.delivered(), TopicsUpdated)
+	expectNames(t, frontend.delivered(), Notification, Error)
+}
@@ -19,18 +19,11 @@ import (
 
 func getListedFileByHash(Hash string) *models.File {
 
-	var selectedFile *models.File = nil
-
-	mutexes.ListedFilesLock.Lock()
-	for _, file := range ListedFiles {
-		if file.FileHash == Hash {
-			selectedFile = &file
-			break
-		}
+	file, exists := ListedFiles.Get(Hash)
+	if !exists {
+		return nil
 	}
-	mutexes.ListedFilesLock.Unlock()
-
-	return selectedFile
+	return &file
 }
 
 //GetFileChunkMapString returns the chunkmap in hex for a file given by hash
@@ -97,16 +90,68 @@ func SetFilePause(Hashes []string, State bool) {
 
 			if !file.IsPaused && file.IsDownloading {
 				go restartDownload(file.FileHash)
+			} else if file.IsPaused {
+				removeQueuedDownload(file.FileHash)
 			}
 		}
 	}
 }
 
+//SetFileChunkStrategy sets the order in which chunks of a file are downloaded, this takes effect when the download (re)starts
+func SetFileChunkStrategy(Hash string, Strategy string) bool {
+	if !IsValidChunkStrategy(Strategy) {
+		pushError("Error on set chunk strategy", "unknown strategy "+Strategy)
+		return false
+	}
+
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+
+	file, err := dbGetFile(Hash)
+	if err != nil {
+		pushError("Error on set chunk strategy", err.Error())
+		return false
+	}
+
+	file.ChunkStrategy = Strategy
+	dbInsertFile(*file)
+	return true
+}
+
+//SetFileRateLimit sets the download and upload caps of a file in bytes per second, 0 is unlimited
+func SetFileRateLimit(Hash string, DownloadLimit int64, UploadLimit int64) bool {
+	if DownloadLimit < 0 || UploadLimit < 0 {
+		pushError("Error on set rate limit", "limits can not be negative")
+		return false
+	}
+
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+
+	file, err := dbGetFile(Hash)
+	if err != nil {
+		pushError("Error on set rate limit", err.Error())
+		return false
+	}
+
+	file.DownloadLimit = DownloadLimit
+	file.UploadLimit = UploadLimit
+	dbInsertFile(*file)
+	return true
+}
+
 //RemoveFileByHash removes file from surge db and optionally from disk
 func RemoveFileByHash(Hash string, FromDisk bool) bool {
 
 	mutexes.FileWriteLock.Lock()
 
+	//Removing a bundle removes all of its files
+	bundle, err := dbGetBundle(Hash)
+	if err == nil {
+		defer mutexes.FileWriteLock.Unlock()
+		return removeBundle(bundle, FromDisk)
+	}
+
 	file, err := dbGetFile(Hash)
 	if !FromDisk && err != nil {
 		pushError("Error on remove file (read db)", err.Error())
@@ -125,6 +170,9 @@ func RemoveFileByHash(Hash string, FromDisk bool) bool {
 		pushError("Error on remove file (read db)", err.Error())
 		return false
 	}
+	removeChunkHashes(Hash)
+	removeFileBuckets(Hash)
+	removeQueuedDownload(Hash)
 	mutexes.FileWriteLock.Unlock()
 
 	log.Println("Removing file:", file.FileName, file.FileHash, "from disk:", FromDisk)
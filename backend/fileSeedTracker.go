@@ -1,12 +1,37 @@
 package surge
 
-import "sync"
+import (
+	"log"
+	"sync"
+	"time"
+
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/mutexes"
+)
 
 var fileSeedMap map[string][]string
 var fileSeedLock = sync.Mutex{}
 
+//Chunk maps of partial seeders by file hash and seeder address, seeders without an entry have all chunks
+var fileSeederChunkMaps map[string]map[string][]byte
+
+//Seeders named by magnet links by file hash
+var peerHintsMap map[string][]string
+
+//Peer hints added as seeders again without opening a session since, by file hash and peer
+var peerHintRetries map[string]map[string]*peerHintRetry
+
+type peerHintRetry struct {
+	attempts int
+	retryAt  time.Time
+}
+
 func InitializeFileSeedTracker() {
 	fileSeedMap = make(map[string][]string)
+	fileSeederChunkMaps = make(map[string]map[string][]byte)
+	peerHintsMap = make(map[string][]string)
+	peerHintRetries = make(map[string]map[string]*peerHintRetry)
 	fileSeedLock = sync.Mutex{}
 }
 
@@ -34,6 +59,7 @@ func RemoveFileSeeder(fileHash string, addr string) {
 
 func removeFileSeeder(fileHash string, addr string) {
 	fileSeedMap[fileHash] = removeStringFromSlice(fileSeedMap[fileHash], addr)
+	delete(fileSeederChunkMaps[fileHash], addr)
 
 	//TODO: should we set to nil the filemap key when len = 0?
 }
@@ -64,3 +90,172 @@ func GetSeeders(fileHash string) []string {
 
 	return fileSeedMap[fileHash]
 }
+
+//SetPartialSeeder marks a seeder as only having the chunks in the given chunk map, an empty map means no chunks are known yet
+func SetPartialSeeder(fileHash string, addr string, chunkMap []byte) {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	_, exists := fileSeederChunkMaps[fileHash]
+	if !exists {
+		fileSeederChunkMaps[fileHash] = make(map[string][]byte)
+	}
+
+	if chunkMap == nil {
+		chunkMap = []byte{}
+	}
+	fileSeederChunkMaps[fileHash][addr] = chunkMap
+}
+
+//SetFullSeeder marks a seeder as having all chunks of a file
+func SetFullSeeder(fileHash string, addr string) {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	delete(fileSeederChunkMaps[fileHash], addr)
+}
+
+//IsPartialSeeder returns whether the seeder only has some chunks of a file
+func IsPartialSeeder(fileHash string, addr string) bool {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	_, partial := fileSeederChunkMaps[fileHash][addr]
+	return partial
+}
+
+//SeederHasChunk returns whether a seeder has a chunk of a file
+func SeederHasChunk(fileHash string, addr string, chunkID int) bool {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	chunkMap, partial := fileSeederChunkMaps[fileHash][addr]
+	if !partial {
+		return true
+	}
+	if chunkID < 0 || chunkID/8 >= len(chunkMap) {
+		return false
+	}
+	return bitmap.Get(chunkMap, chunkID)
+}
+
+//GetPartialSeeders returns the seeders of a file that only have some chunks
+func GetPartialSeeders(fileHash string) []string {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	partialSeeders := []string{}
+	for addr := range fileSeederChunkMaps[fileHash] {
+		partialSeeders = append(partialSeeders, addr)
+	}
+	return partialSeeders
+}
+
+// adds the seeders a magnet link names for a file, so it can be downloaded without being announced in a subscribed topic
+func addPeerHints(fileHash string, peers []string, isBundle bool) {
+	self := GetAccountAddress()
+	hints := []string{}
+	for _, peer := range peers {
+		if peer != self {
+			hints = append(hints, peer)
+		}
+	}
+
+	fileSeedLock.Lock()
+	peerHintsMap[fileHash] = distinctStringSlice(append(peerHintsMap[fileHash], hints...))
+	fileSeedLock.Unlock()
+
+	for _, peer := range hints {
+		AddFileSeeder(fileHash, peer)
+		if isBundle {
+			addBundleSeeder(fileHash, peer)
+		}
+	}
+}
+
+// returns the seeders magnet links named for a file
+func getPeerHints(fileHash string) []string {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	return append([]string{}, peerHintsMap[fileHash]...)
+}
+
+// adds the peer hints stored with a download as seeders again, they are dropped like any seeder when their session ends
+// hints that do not open a session are retried with a growing delay and removed from the download after PeerHintAttempts attempts
+func restorePeerHints(fileHash string) {
+	file, err := dbGetFile(fileHash)
+	if err != nil || len(file.PeerHints) == 0 {
+		return
+	}
+
+	due, dropped := duePeerHints(fileHash, file.PeerHints)
+	for _, peer := range due {
+		AddFileSeeder(fileHash, peer)
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	log.Println("Dropping peer hints for", fileHash, "that did not open a session", dropped)
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+
+	file, err = dbGetFile(fileHash)
+	if err != nil {
+		return
+	}
+	for _, peer := range dropped {
+		file.PeerHints = removeStringFromSlice(file.PeerHints, peer)
+	}
+	dbInsertFile(*file)
+}
+
+// returns the hints that are due to be added as seeders again and the hints that ran out of attempts
+func duePeerHints(fileHash string, hints []string) ([]string, []string) {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	if peerHintRetries[fileHash] == nil {
+		peerHintRetries[fileHash] = make(map[string]*peerHintRetry)
+	}
+
+	due := []string{}
+	dropped := []string{}
+	for _, peer := range hints {
+		//Still a seeder, nothing to restore
+		if containsString(fileSeedMap[fileHash], peer) {
+			continue
+		}
+
+		retry, exists := peerHintRetries[fileHash][peer]
+		if !exists {
+			retry = &peerHintRetry{}
+			peerHintRetries[fileHash][peer] = retry
+		}
+		if time.Now().Before(retry.retryAt) {
+			continue
+		}
+		if retry.attempts >= constants.PeerHintAttempts {
+			dropped = append(dropped, peer)
+			delete(peerHintRetries[fileHash], peer)
+			peerHintsMap[fileHash] = removeStringFromSlice(peerHintsMap[fileHash], peer)
+			continue
+		}
+
+		retry.retryAt = time.Now().Add(time.Second * constants.PeerHintRetryDelay << retry.attempts)
+		retry.attempts++
+		due = append(due, peer)
+	}
+	return due, dropped
+}
+
+// resets the retries of a peer once it opened a session
+func resetPeerHintRetries(addr string) {
+	fileSeedLock.Lock()
+	defer fileSeedLock.Unlock()
+
+	for _, retries := range peerHintRetries {
+		delete(retries, addr)
+	}
+}
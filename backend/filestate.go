@@ -0,0 +1,197 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the in-memory file state
+	Files are cached once read from the db. Chunk map and shared chunk changes only update the cache
+	and are flushed to the db on an interval and on shutdown, other changes are written through.
+	Like every read, change and write of a file these updates hold mutexes.FileWriteLock, a file written through
+	therefore always carries the latest chunk map.
+	Downloaded data is synced to disk before its chunks are stored as available, so after a crash a download
+	resumes from a chunk map that never claims more than is on disk, at worst a few chunks are downloaded again.
+*/
+
+package surge
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/mutexes"
+	"github.com/xujiajun/nutsdb"
+)
+
+//Cached files by hash
+var fileStates = map[string]*models.File{}
+
+//hashes of cached files with changes not yet in the db
+var dirtyFileStates = map[string]bool{}
+
+//guards the cache and every access to the file bucket
+var fileStateLock = sync.Mutex{}
+
+// returns a copy of a file that shares no memory with the original
+func cloneFile(File *models.File) *models.File {
+	clone := *File
+	clone.ChunkMap = append([]byte(nil), File.ChunkMap...)
+	return &clone
+}
+
+// returns the cached file, reading it from the db when it is not cached yet, call with fileStateLock held
+func getFileState(Hash string) (*models.File, error) {
+	if file, exists := fileStates[Hash]; exists {
+		return file, nil
+	}
+
+	file := &models.File{}
+	if err := db.View(
+		func(tx *nutsdb.Tx) error {
+			e, err := tx.Get(fileBucketName, []byte(Hash))
+			if err != nil {
+				return err
+			}
+			return json.Unmarshal(e.Value, file)
+		}); err != nil {
+		return nil, err
+	}
+
+	fileStates[Hash] = file
+	return file, nil
+}
+
+// marks a chunk as downloaded, it reaches the db with the next flush
+func setChunkAvailable(Hash string, ChunkID int32) {
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
+	file, err := getFileState(Hash)
+	if err != nil {
+		pushError("Error on chunk write (db get)", err.Error())
+		return
+	}
+	if ChunkID < 0 || int(ChunkID) >= file.NumChunks || len(file.ChunkMap)*8 < file.NumChunks {
+		log.Println("Chunk out of range of chunk map", Hash, ChunkID)
+		return
+	}
+
+	bitmap.Set(file.ChunkMap, int(ChunkID), true)
+	dirtyFileStates[Hash] = true
+}
+
+// counts a transmitted chunk, it reaches the db with the next flush
+func addChunkShared(Hash string) {
+	mutexes.FileWriteLock.Lock()
+	defer mutexes.FileWriteLock.Unlock()
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
+	file, err := getFileState(Hash)
+	if err != nil {
+		return
+	}
+
+	file.ChunksShared++
+	dirtyFileStates[Hash] = true
+}
+
+// forgets a file, its unflushed changes are dropped, call with fileStateLock held
+func removeFileState(Hash string) {
+	delete(fileStates, Hash)
+	delete(dirtyFileStates, Hash)
+}
+
+// syncs written chunks of a download to disk so they survive a crash
+func syncFileData(File *models.File) {
+	if !File.IsDownloading {
+		return
+	}
+
+	osFile, err := os.OpenFile(File.Path, os.O_RDWR, 0644)
+	if err != nil {
+		return
+	}
+	defer osFile.Close()
+
+	if err := osFile.Sync(); err != nil {
+		log.Println("Failed to sync", File.FileName, err)
+	}
+}
+
+// writes the cached changes to the db
+func flushFileStates() {
+	//Take a snapshot of the chunk maps before syncing, chunks written after it are not synced yet
+	fileStateLock.Lock()
+	snapshots := []*models.File{}
+	for hash := range dirtyFileStates {
+		snapshots = append(snapshots, cloneFile(fileStates[hash]))
+	}
+	fileStateLock.Unlock()
+
+	if len(snapshots) == 0 {
+		return
+	}
+
+	for _, snapshot := range snapshots {
+		syncFileData(snapshot)
+	}
+
+	fileStateLock.Lock()
+	defer fileStateLock.Unlock()
+
+	flushed := []string{}
+	if err := db.Update(
+		func(tx *nutsdb.Tx) error {
+			for _, snapshot := range snapshots {
+				file, exists := fileStates[snapshot.FileHash]
+				if !exists || !dirtyFileStates[snapshot.FileHash] {
+					//Removed or written through meanwhile
+					continue
+				}
+
+				//Only store chunks that were synced and are still available
+				persisted := cloneFile(file)
+				for i := range persisted.ChunkMap {
+					if i < len(snapshot.ChunkMap) {
+						persisted.ChunkMap[i] &= snapshot.ChunkMap[i]
+					} else {
+						persisted.ChunkMap[i] = 0
+					}
+				}
+
+				fileBytes, _ := json.Marshal(persisted)
+				if err := tx.Put(fileBucketName, []byte(persisted.FileHash), fileBytes, 0); err != nil {
+					return err
+				}
+				//Chunks that were not synced stay dirty until the next flush
+				if bytes.Equal(persisted.ChunkMap, file.ChunkMap) {
+					flushed = append(flushed, persisted.FileHash)
+				}
+			}
+			return nil
+		}); err != nil {
+		log.Println("Failed to flush file states", err)
+		return
+	}
+
+	for _, hash := range flushed {
+		delete(dirtyFileStates, hash)
+	}
+}
+
+// flushes the cached file changes to the db on an interval
+func fileStateFlushWorker() {
+	for {
+		time.Sleep(time.Second * constants.FileStateFlushInterval)
+		flushFileStates()
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the headless mode
+	In headless mode surge runs without the wails window, events are written to the log instead
+*/
+
+package surge
+
+import (
+	"log"
+	"time"
+
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/platform"
+)
+
+//InitializeHeadless prepares the backend to run without a wails frontend, call before StartClient
+func InitializeHeadless() {
+	//There is no frontend, events are written to the log
+	frontendEvents.Unsubscribe()
+	SubscribeEvents(logEventHandler)
+	platform.SetHeadlessHandler(headlessAskUser)
+
+	FrontendReady = true
+
+	startWorkers := func() {
+		//Wait for our client to initialize, perhaps there is no internet connectivity
+		for !clientInitialized {
+			time.Sleep(time.Second)
+		}
+		updateFileDataWorker()
+	}
+	go startWorkers()
+
+	log.Println("Running in headless mode")
+}
+
+// writes backend events to the log, bandwidth updates are skipped as they fire every second
+func logEventHandler(event events.Event) {
+	if event.Name == events.BandwidthUpdate {
+		return
+	}
+	log.Println(append([]interface{}{"Event:", event.Name}, event.Data...)...)
+}
+
+// answers user prompts that would otherwise be shown in the frontend
+func headlessAskUser(context string, payload string) {
+	switch context {
+	case "startDownloadMagnetLinks":
+		startDownloadMagnetLinks(payload)
+	default:
+		log.Println("Headless mode ignored user prompt:", context, payload)
+	}
+}
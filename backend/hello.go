@@ -0,0 +1,113 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the session handshake
+	Both peers send a hello when a session opens. Peers that never send one run an older surge and are treated as the legacy protocol version,
+	which only knows chunk frames, so newer frames are only sent to peers announcing the feature.
+*/
+
+package surge
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+)
+
+//Hellos received by peer address
+var peerHellos = map[string]models.Hello{}
+var peerHellosLock = sync.Mutex{}
+
+//features we announce to peers
+var supportedFeatures = []string{
+	constants.FeatureChunkHashes,
+	constants.FeaturePartialSeeds,
+	constants.FeatureBundles,
+	constants.FeatureChunkReplies,
+}
+
+// SendHello sends our protocol version and features to a peer
+func SendHello(Session *sessionmanager.Session) bool {
+	hello := models.Hello{
+		ProtocolVersion: constants.ProtocolVersion,
+		ClientVersion:   constants.ClientVersion,
+		Features:        supportedFeatures,
+	}
+	helloSerialized, err := json.Marshal(hello)
+	if err != nil {
+		log.Println("Failed to encode hello:", err)
+		return false
+	}
+
+	_, err = SessionWrite(Session, helloSerialized, constants.SurgeHelloID)
+	if err != nil {
+		log.Println("Failed to send hello", err)
+		return false
+	}
+	return true
+}
+
+func processHello(Session *sessionmanager.Session, Data []byte) {
+	addr := Session.Session.RemoteAddr().String()
+
+	hello := models.Hello{}
+	if err := json.Unmarshal(Data, &hello); err != nil {
+		log.Println("Failed to parse hello from", addr, err)
+		return
+	}
+
+	//We can not talk to peers older than our minimum, newer peers talk down to us
+	if hello.ProtocolVersion < constants.MinProtocolVersion {
+		log.Println("Closing session with", addr, "unsupported protocol version", hello.ProtocolVersion)
+		sessionmanager.CloseSession(addr)
+		return
+	}
+
+	peerHellosLock.Lock()
+	peerHellos[addr] = hello
+	peerHellosLock.Unlock()
+
+	log.Println("Hello from", addr, "protocol", hello.ProtocolVersion, "client", hello.ClientVersion, "features", hello.Features)
+}
+
+// removes the hello of a disconnected peer, a new session sends a new hello
+func removePeerHello(addr string) {
+	peerHellosLock.Lock()
+	defer peerHellosLock.Unlock()
+
+	delete(peerHellos, addr)
+}
+
+//GetPeerHello returns the hello of a peer, false when none was received
+func GetPeerHello(addr string) (models.Hello, bool) {
+	peerHellosLock.Lock()
+	defer peerHellosLock.Unlock()
+
+	hello, exists := peerHellos[addr]
+	return hello, exists
+}
+
+// returns whether a peer announced a feature, sessions that just opened get some time for their hello to arrive
+func peerSupports(addr string, feature string) bool {
+	for i := 0; i < constants.HelloReceiveTimeout*10; i++ {
+		hello, exists := GetPeerHello(addr)
+		if exists {
+			return containsString(hello.Features, feature)
+		}
+
+		//Without a session there will be no hello
+		session, exists := sessionmanager.GetExistingSessionWithoutClosing(addr, constants.WorkerGetSessionTimeout)
+		if !exists || session == nil || time.Now().Unix()-session.OpenedUnix > constants.HelloReceiveTimeout {
+			return false
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return false
+}
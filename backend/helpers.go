@@ -3,12 +3,12 @@ package surge
 import (
 	b64 "encoding/base64"
 	"fmt"
-	"strconv"
 	"strings"
 
 	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/magnet"
 	"github.com/rule110-io/surge/backend/models"
-	"github.com/rule110-io/surge/backend/mutexes"
 )
 
 func removeStringFromSlice(s []string, r string) []string {
@@ -20,6 +20,22 @@ func removeStringFromSlice(s []string, r string) []string {
 	return s
 }
 
+func insertString(s []string, index int, r string) []string {
+	s = append(s, "")
+	copy(s[index+1:], s[index:])
+	s[index] = r
+	return s
+}
+
+func containsString(s []string, r string) bool {
+	for _, v := range s {
+		if v == r {
+			return true
+		}
+	}
+	return false
+}
+
 func distinctStringSlice(stringSlice []string) []string {
 	keys := make(map[string]bool)
 	list := []string{}
@@ -52,21 +68,65 @@ func TopicEncode(topic string) string {
 	return "SRG_" + strings.ReplaceAll(b64.StdEncoding.EncodeToString([]byte(topic)), "=", "-")
 }
 
+//TopicDecode returns the topic name of an encoded topic
+func TopicDecode(topicEncoded string) string {
+	decoded, err := b64.StdEncoding.DecodeString(strings.ReplaceAll(strings.TrimPrefix(topicEncoded, "SRG_"), "-", "="))
+	if err != nil {
+		return topicEncoded
+	}
+	return string(decoded)
+}
+
 func surgeGenerateTopicPayload(fileName string, sizeInBytes int64, hash string, topic string) string {
 	//Example payload
-	//surge://|file|The_Two_Towers-The_Purist_Edit-Trailer.avi|14997504|965c013e991ee246d63d45ea71954c4d|/
+	//surge:?v=1&xt=sha256:965c013e...&dn=The_Two_Towers-The_Purist_Edit-Trailer.avi&xl=14997504&tp=surge
+	//surge://|file|The_Two_Towers-The_Purist_Edit-Trailer.avi|14997504|965c013e...|surge|/
+
+	//Peers that do not know the uri format only read the legacy line, we read both as the same listing
+	link := magnet.Link{Kind: magnet.KindFile, Name: fileName, Size: sizeInBytes, Hash: hash, Topic: topic}
+	if legacy := link.LegacyString(); len(legacy) > 0 {
+		return link.String() + "\n" + legacy
+	}
+	return link.String()
+}
+
+func surgeGeneratePartialTopicPayload(fileName string, sizeInBytes int64, hash string, topic string) string {
+	//Same as a file payload, but announces we only have some chunks
+	//surge:?v=1&xt=sha256:965c013e...&dn=The_Two_Towers-The_Purist_Edit-Trailer.avi&xl=14997504&kind=partial&tp=surge
 
-	return "surge://|file|" + fileName + "|" + strconv.FormatInt(sizeInBytes, 10) + "|" + hash + "|" + topic + "|/"
+	return magnet.Link{Kind: magnet.KindPartial, Name: fileName, Size: sizeInBytes, Hash: hash, Topic: topic}.String()
+}
+
+func surgeGenerateBundleTopicPayload(bundleName string, sizeInBytes int64, hash string, topic string) string {
+	//A seeded directory, the hash is the hash of its manifest
+	//surge:?v=1&xt=sha256:0f8a0c4c...&dn=The_Two_Towers-Extras&xl=149975040&kind=bundle&tp=surge
+
+	return magnet.Link{Kind: magnet.KindBundle, Name: bundleName, Size: sizeInBytes, Hash: hash, Topic: topic}.String()
 }
 
 func surgeGenerateMagnetLink(fileName string, sizeInBytes int64, hash string, seeder string, topic string) string {
 	//Example payload
-	//surge://|file|The_Two_Towers-The_Purist_Edit-Trailer.avi|14997504|965c013e991ee246d63d45ea71954c4d|/
+	//surge:?v=1&xt=sha256:965c013e...&dn=The_Two_Towers-The_Purist_Edit-Trailer.avi&xl=14997504&tp=surge&peer=7a48870a...
 	if seeder == "" {
 		seeder = GetAccountAddress()
 	}
 
-	return "surge://|file|" + fileName + "|" + strconv.FormatInt(sizeInBytes, 10) + "|" + hash + "|" + seeder + "|" + topic + "|/"
+	return magnet.Link{Kind: magnet.KindFile, Name: fileName, Size: sizeInBytes, Hash: hash, Topic: topic, Peers: []string{seeder}}.String()
+}
+
+// returns the listing a link describes
+func linkToListing(link magnet.Link) models.File {
+	return models.File{
+		FileName:  link.Name,
+		FileSize:  link.Size,
+		FileHash:  link.Hash,
+		Path:      "",
+		NumChunks: int((link.Size-1)/int64(constants.ChunkSize)) + 1,
+		ChunkMap:  nil,
+		Topic:     link.Topic,
+		IsBundle:  link.Kind == magnet.KindBundle,
+		PeerHints: link.Peers,
+	}
 }
 
 func hashFile(randomHash string) {
@@ -78,10 +138,12 @@ func hashFile(randomHash string) {
 		pushError("File Hash Failed", "Could find dbEntry for hash "+randomHash)
 	}
 
-	hashString, err := HashFile(dbFile.Path)
+	hashString, chunkHashes, err := HashFileChunks(dbFile.Path)
 	if err != nil {
 		pushError("File Hash Failed", "Could not hash file at "+dbFile.Path)
+		return
 	}
+	setChunkHashes(hashString, chunkHashes)
 
 	dbFile.IsUploading = true
 	dbFile.IsHashing = false
@@ -91,52 +153,22 @@ func hashFile(randomHash string) {
 	AnnounceNewFile(dbFile)
 
 	pushNotification("Now seeding", dbFile.FileName)
+	emitFileEvent(events.FileSeeded, dbFile, "")
 }
 
-// ParsePayloadString parses payload of files
-func ParsePayloadString(s string) []models.File {
+// ParsePayloadString parses the files of magnet links, links that could not be parsed are returned as errors
+func ParsePayloadString(s string) ([]models.File, []error) {
 
 	files := []models.File{}
-	payloadSplit := strings.Split(s, "surge://")
-	for j := 0; j < len(payloadSplit); j++ {
-		data := strings.Split(payloadSplit[j], "|")
-
-		if len(data) < 3 {
-			continue
-		}
+	links, errs := magnet.ParseAll(s)
+	for _, link := range links {
+		newListing := linkToListing(link)
 
-		fileSize, _ := strconv.ParseInt(data[3], 10, 64)
-		numChunks := int((fileSize-1)/int64(constants.ChunkSize)) + 1
-
-		newListing := models.File{
-			FileName:  data[2],
-			FileSize:  fileSize,
-			FileHash:  data[4],
-			Path:      "",
-			NumChunks: numChunks,
-			ChunkMap:  nil,
-			Topic:     data[5],
-		}
-
-		mutexes.ListedFilesLock.Lock()
-		//Replace existing, or remove.
-		var replace = false
-		for l := 0; l < len(ListedFiles); l++ {
-			if ListedFiles[l].FileHash == newListing.FileHash {
-				//if the seeder is unique add it as an additional seeder for the file
-				replace = true
-				break
-			}
-		}
-		//Unique listing so we add
-		if !replace {
-			ListedFiles = append(ListedFiles, newListing)
-		}
-		mutexes.ListedFilesLock.Unlock()
+		ListedFiles.Add(newListing)
 
 		files = append(files, newListing)
 	}
-	return files
+	return files, errs
 }
 
 func filterFile(ss []models.File, test func(models.File) bool) (ret []models.File) {
@@ -0,0 +1,153 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the hooks file
+	Hooks are configured in a json file in the surge dir, so only users with access to the machine can add them.
+	The node reads it on start and when asked to reload, surge-cli edits it.
+*/
+
+package hookfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/platform"
+)
+
+//Events hooks can be added for
+var Events = []events.Name{
+	events.DownloadStarted,
+	events.DownloadFinished,
+	events.VerificationFailed,
+	events.FileSeeded,
+	events.NewListing,
+	events.TopicStateChanged,
+}
+
+//Path returns the path of the hooks file
+func Path() string {
+	return platform.GetSurgeDir() + string(os.PathSeparator) + constants.HooksFile
+}
+
+//Read returns the hooks in the hooks file, none when there is no file
+func Read() ([]models.Hook, error) {
+	hooks := []models.Hook{}
+
+	hooksBytes, err := ioutil.ReadFile(Path())
+	if os.IsNotExist(err) {
+		return hooks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(hooksBytes, &hooks)
+	if err != nil {
+		return nil, errors.New("invalid hooks file " + Path() + ": " + err.Error())
+	}
+	return hooks, nil
+}
+
+//Write replaces the hooks in the hooks file
+func Write(hooks []models.Hook) error {
+	hooksBytes, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(Path(), hooksBytes, 0600)
+}
+
+//Add validates a hook running the target on the event and adds it to the hooks file
+func Add(Event string, Type string, Target string) (models.Hook, error) {
+	err := Validate(Event, Type, Target)
+	if err != nil {
+		return models.Hook{}, err
+	}
+
+	hooks, err := Read()
+	if err != nil {
+		return models.Hook{}, err
+	}
+
+	id := make([]byte, 4)
+	_, err = rand.Read(id)
+	if err != nil {
+		return models.Hook{}, err
+	}
+
+	hook := models.Hook{
+		ID:     hex.EncodeToString(id),
+		Event:  Event,
+		Type:   Type,
+		Target: Target,
+	}
+	return hook, Write(append(hooks, hook))
+}
+
+//Remove removes a hook by its id from the hooks file
+func Remove(ID string) error {
+	hooks, err := Read()
+	if err != nil {
+		return err
+	}
+
+	for i, hook := range hooks {
+		if hook.ID == ID {
+			return Write(append(hooks[:i], hooks[i+1:]...))
+		}
+	}
+	return errors.New("no hook with id " + ID)
+}
+
+//IsValidEvent returns whether hooks can be added for the event
+func IsValidEvent(event string) bool {
+	for _, name := range Events {
+		if string(name) == event {
+			return true
+		}
+	}
+	return false
+}
+
+//Validate checks a hook runs an existing executable or posts to an http url on a known event
+func Validate(event string, hookType string, target string) error {
+	if !IsValidEvent(event) {
+		return errors.New("unknown event " + event)
+	}
+	if len(target) == 0 {
+		return errors.New("target of length zero")
+	}
+
+	switch hookType {
+	case constants.HookTypeExec:
+		//An absolute path so the hook does not depend on the working directory or PATH
+		if !filepath.IsAbs(target) {
+			return errors.New("exec target is not an absolute path: " + target)
+		}
+		info, err := os.Stat(target)
+		if err != nil || !info.Mode().IsRegular() {
+			return errors.New("exec target is not an existing file: " + target)
+		}
+		return nil
+	case constants.HookTypeWebhook:
+		webhookURL, err := url.Parse(target)
+		if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || len(webhookURL.Host) == 0 {
+			return errors.New("webhook target is not an http url: " + target)
+		}
+		return nil
+	default:
+		return errors.New("unknown hook type " + hookType)
+	}
+}
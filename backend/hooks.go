@@ -0,0 +1,248 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the event hooks
+	A hook runs an executable or posts to a webhook when a download, seed, listing or topic event is emitted.
+	Executables get the event in environment variables and as json on stdin, webhooks get the json as body.
+	Hooks are configured in the hooks file in the surge dir. Failing hooks are retried, every attempt is kept in the hook log.
+*/
+
+package surge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/hookfile"
+	"github.com/rule110-io/surge/backend/models"
+)
+
+var hooks = []models.Hook{}
+var hookLog = []models.HookExecution{}
+var hooksLock = sync.Mutex{}
+
+//InitializeHooks loads the hooks file and starts running hooks on events
+func InitializeHooks() {
+	ReloadHooks()
+
+	SubscribeEvents(runHooks, hookfile.Events...)
+}
+
+//ReloadHooks reads the hooks file again, hooks that are not valid anymore are skipped
+func ReloadHooks() bool {
+	fileHooks, err := hookfile.Read()
+	if err != nil {
+		pushError("Error on load hooks", err.Error())
+		return false
+	}
+
+	validHooks := []models.Hook{}
+	for _, hook := range fileHooks {
+		err := hookfile.Validate(hook.Event, hook.Type, hook.Target)
+		if err != nil {
+			log.Println("Skipping hook", hook.ID, err)
+			continue
+		}
+		validHooks = append(validHooks, hook)
+	}
+
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	hooks = validHooks
+	return true
+}
+
+//GetHooks returns the hooks
+func GetHooks() []models.Hook {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	return append([]models.Hook{}, hooks...)
+}
+
+//GetHookLog returns the most recent hook executions, oldest first
+func GetHookLog() []models.HookExecution {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	return append([]models.HookExecution{}, hookLog...)
+}
+
+// runs the hooks of an event, every hook runs on its own so a slow hook does not hold up the others or the event bus
+func runHooks(event events.Event) {
+	matching := []models.Hook{}
+	hooksLock.Lock()
+	for _, hook := range hooks {
+		if hook.Event == string(event.Name) {
+			matching = append(matching, hook)
+		}
+	}
+	hooksLock.Unlock()
+
+	if len(matching) == 0 {
+		return
+	}
+
+	payload := hookPayload(event)
+	for _, hook := range matching {
+		go runHook(hook, payload)
+	}
+}
+
+// returns the payload hooks receive for an event
+func hookPayload(event events.Event) models.HookPayload {
+	payload := models.HookPayload{
+		Event: string(event.Name),
+		Time:  event.Time,
+	}
+	if len(event.Data) == 0 {
+		return payload
+	}
+
+	switch data := event.Data[0].(type) {
+	case events.FileEvent:
+		payload.FileHash = data.FileHash
+		payload.FileName = data.FileName
+		payload.FileSize = data.FileSize
+		payload.Path = data.Path
+		payload.Topic = data.Topic
+		payload.Error = data.Error
+	case events.TopicEvent:
+		payload.Topic = data.Topic
+		payload.State = data.State
+	}
+	return payload
+}
+
+// runs a hook until it succeeds or runs out of attempts, waiting longer after every failure
+func runHook(hook models.Hook, payload models.HookPayload) {
+	defer RecoverAndLog()
+
+	delay := time.Second * constants.HookRetryDelay
+	for attempt := 1; attempt <= constants.HookAttempts; attempt++ {
+		start := time.Now()
+
+		var output string
+		var err error
+		if hook.Type == constants.HookTypeWebhook {
+			output, err = runWebhook(hook.Target, payload)
+		} else {
+			output, err = runExecHook(hook.Target, payload)
+		}
+
+		execution := models.HookExecution{
+			HookID:   hook.ID,
+			Event:    hook.Event,
+			Target:   hook.Target,
+			Attempt:  attempt,
+			Success:  err == nil,
+			Output:   truncateHookOutput(output),
+			Time:     start.Unix(),
+			Duration: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			execution.Error = err.Error()
+		}
+		logHookExecution(execution)
+
+		if err == nil {
+			return
+		}
+		if attempt < constants.HookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// runs an executable with the event in its environment and the payload json on stdin
+func runExecHook(target string, payload models.HookPayload) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*constants.HookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, target)
+	cmd.Env = append(os.Environ(),
+		"SURGE_EVENT="+payload.Event,
+		"SURGE_FILE_HASH="+payload.FileHash,
+		"SURGE_FILE_NAME="+payload.FileName,
+		"SURGE_FILE_SIZE="+strconv.FormatInt(payload.FileSize, 10),
+		"SURGE_FILE_PATH="+payload.Path,
+		"SURGE_TOPIC="+payload.Topic,
+		"SURGE_TOPIC_STATE="+strconv.Itoa(payload.State),
+		"SURGE_ERROR="+payload.Error,
+		"SURGE_PAYLOAD="+string(payloadBytes),
+	)
+	cmd.Stdin = bytes.NewReader(payloadBytes)
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errors.New("timed out after " + strconv.Itoa(constants.HookTimeout) + " seconds")
+	}
+	return string(output), err
+}
+
+// posts the payload json to a webhook, any 2xx status is a success
+func runWebhook(target string, payload models.HookPayload) (string, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	httpClient := http.Client{Timeout: time.Second * constants.HookTimeout}
+	response, err := httpClient.Post(target, "application/json", bytes.NewReader(payloadBytes))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, constants.HookOutputLimit))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return string(body), errors.New("webhook responded " + response.Status)
+	}
+	return string(body), nil
+}
+
+func truncateHookOutput(output string) string {
+	if len(output) > constants.HookOutputLimit {
+		return output[:constants.HookOutputLimit]
+	}
+	return output
+}
+
+// appends an execution to the hook log, the oldest executions are dropped once the log is full
+func logHookExecution(execution models.HookExecution) {
+	if execution.Success {
+		log.Println("Hook", execution.HookID, "ran for", execution.Event, "attempt", execution.Attempt)
+	} else {
+		log.Println("Hook", execution.HookID, "failed for", execution.Event, "attempt", execution.Attempt, execution.Error)
+	}
+
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+
+	hookLog = append(hookLog, execution)
+	if len(hookLog) > constants.HookLogSize {
+		hookLog = append([]models.HookExecution{}, hookLog[len(hookLog)-constants.HookLogSize:]...)
+	}
+}
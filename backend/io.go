@@ -18,48 +18,56 @@ import (
 	"path/filepath"
 	"time"
 
-	bitmap "github.com/boljen/go-bitmap"
 	"github.com/rule110-io/surge/backend/constants"
-	"github.com/rule110-io/surge/backend/mutexes"
+	"github.com/rule110-io/surge/backend/events"
+	"github.com/rule110-io/surge/backend/models"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
-func emitNotificationEvent(event string, title string, text string) {
-	runtime.EventsEmit(*wailsContext, event, title, text, time.Now().Unix())
+//Bus all backend events are emitted on
+var eventBus = events.NewBus()
+
+//The wails frontend receives events once it is bound, events emitted before are queued
+var frontendEvents = eventBus.SubscribePaused(wailsEventHandler)
+
+func wailsEventHandler(event events.Event) {
+	runtime.EventsEmit(*wailsContext, string(event.Name), event.Data...)
+}
+
+//SubscribeEvents delivers backend events to the handler, only the given events when names are given
+func SubscribeEvents(handler events.Handler, names ...events.Name) *events.Subscription {
+	return eventBus.Subscribe(handler, names...)
+}
+
+func emitEvent(name events.Name, data ...interface{}) {
+	eventBus.Emit(name, data...)
+}
+
+func emitNotificationEvent(name events.Name, title string, text string) {
+	emitEvent(name, title, text, time.Now().Unix())
+}
+
+// emits a file lifecycle event, errText describes why the event happened when it is a failure
+func emitFileEvent(name events.Name, file *models.File, errText string) {
+	emitEvent(name, events.FileEvent{
+		FileHash: file.FileHash,
+		FileName: file.FileName,
+		FileSize: file.FileSize,
+		Path:     file.Path,
+		Topic:    file.Topic,
+		Error:    errText,
+	})
 }
 
 func pushNotification(title string, text string) {
 	log.Println(title, text)
-	//If wails frontend is not yet bound, we wait in a task to not block main thread
-	if !FrontendReady {
-		waitAndPush := func() {
-			for !FrontendReady {
-				time.Sleep(time.Millisecond * 50)
-			}
-			emitNotificationEvent("notificationEvent", title, text)
-		}
-		go waitAndPush()
-	} else {
-		emitNotificationEvent("notificationEvent", title, text)
-	}
+	emitNotificationEvent(events.Notification, title, text)
 }
 
 func pushError(title string, text string) {
 	log.Println(title, text)
-
-	//If wails frontend is not yet bound, we wait in a task to not block main thread
-	if !FrontendReady {
-		waitAndPush := func() {
-			for !FrontendReady {
-				time.Sleep(time.Millisecond * 50)
-			}
-			emitNotificationEvent("errorEvent", title, text)
-		}
-		go waitAndPush()
-	} else {
-		emitNotificationEvent("errorEvent", title, text)
-	}
+	emitNotificationEvent(events.Error, title, text)
 }
 
 //SetVisualMode Sets the visualmode
@@ -67,11 +75,11 @@ func SetVisualMode(visualMode int) {
 	if visualMode == 0 {
 		//light mode
 		DbWriteSetting("DarkMode", "false")
-		runtime.EventsEmit(*wailsContext, "darkThemeEvent", "false")
+		emitEvent(events.DarkTheme, "false")
 	} else if visualMode == 1 {
 		//dark mode
 		DbWriteSetting("DarkMode", "true")
-		runtime.EventsEmit(*wailsContext, "darkThemeEvent", "true")
+		emitEvent(events.DarkTheme, "true")
 	}
 }
 
@@ -104,22 +112,8 @@ func WriteChunk(FileID string, ChunkID int32, Chunk []byte) {
 		return
 	}
 
-	//Update bitmap async as this has a lock in it but does not have to be waited for
-	setBitMap := func() {
-		mutexes.FileWriteLock.Lock()
-
-		//Set chunk to available in the map
-		fileInfo, err := dbGetFile(FileID)
-		if err != nil {
-			pushError("Error on chunk write (db get)", err.Error())
-			return
-		}
-		bitmap.Set(fileInfo.ChunkMap, int(ChunkID), true)
-		dbInsertFile(*fileInfo)
-
-		mutexes.FileWriteLock.Unlock()
-	}
-	go setBitMap()
+	//Set chunk to available in the cached chunk map
+	setChunkAvailable(FileID, ChunkID)
 }
 
 //OpenOSPath Open a file, directory, or URI using the OS's default application for that object type. Don't wait for the open command to complete.
@@ -206,6 +200,38 @@ func HashFile(filePath string) (string, error) {
 
 }
 
+// HashFileChunks generates the hash for file given filepath as well as a sha256 digest per chunk, concatenated in chunk order
+func HashFileChunks(filePath string) (string, []byte, error) {
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	fileHash := sha256.New()
+	chunkHashes := []byte{}
+
+	//Read chunk by chunk, feeding both the file hash and a hash for the chunk
+	buffer := make([]byte, constants.ChunkSize)
+	for {
+		bytesRead, err := io.ReadFull(file, buffer)
+		if bytesRead > 0 {
+			fileHash.Write(buffer[:bytesRead])
+			chunkHash := sha256.Sum256(buffer[:bytesRead])
+			chunkHashes = append(chunkHashes, chunkHash[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return hex.EncodeToString(fileHash.Sum(nil)), chunkHashes, nil
+}
+
 func surgeGetFileSize(path string) int64 {
 
 	fi, err := os.Stat(path)
@@ -0,0 +1,266 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the magnet link format
+	A link is an uri with escaped query values, e.g.
+	surge:?v=1&xt=sha256:<hash>&dn=<name>&xl=<size>&tp=<topic>&peer=<address>
+	kind is partial for peers that only have some chunks and bundle for seeded directories, it is left out for files.
+	peer can be given more than once, unknown parameters are ignored so later versions can add them.
+	The legacy pipe format is still parsed, both the topic payload surge://|file|name|size|hash|topic|/
+	and the magnet link surge://|file|name|size|hash|seeder|topic|/
+	Topic payloads of files are also generated in it, for peers that do not know the uri format.
+*/
+
+package magnet
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Version is the version of the link format we generate and the highest we parse
+const Version = 1
+
+//Kinds of listings a link describes
+const (
+	KindFile    = "file"
+	KindPartial = "partial"
+	KindBundle  = "bundle"
+)
+
+const prefix = "surge:?"
+const legacyPrefix = "surge://"
+const hashPrefix = "sha256:"
+
+//Link describes a listing
+type Link struct {
+	Version int
+	Kind    string
+	Name    string
+	Size    int64
+	Hash    string //hex sha256
+	Topic   string
+	Peers   []string
+}
+
+//Start of every link in a text
+var linkStart = regexp.MustCompile(`surge:(\?|//)`)
+
+//A link in the uri format ends at the first character an escaped query can not contain
+var linkEnd = regexp.MustCompile(`[^A-Za-z0-9\-_.~%+&=:?]`)
+
+//String returns the link in the uri format
+func (l Link) String() string {
+	params := []string{
+		"v=" + strconv.Itoa(Version),
+		"xt=" + hashPrefix + l.Hash,
+		"dn=" + url.QueryEscape(l.Name),
+		"xl=" + strconv.FormatInt(l.Size, 10),
+	}
+	if len(l.Kind) > 0 && l.Kind != KindFile {
+		params = append(params, "kind="+l.Kind)
+	}
+	if len(l.Topic) > 0 {
+		params = append(params, "tp="+url.QueryEscape(l.Topic))
+	}
+	for _, peer := range l.Peers {
+		params = append(params, "peer="+url.QueryEscape(peer))
+	}
+	return prefix + strings.Join(params, "&")
+}
+
+//LegacyString returns the link as a legacy topic payload, empty when the legacy format can not describe it
+func (l Link) LegacyString() string {
+	if (len(l.Kind) > 0 && l.Kind != KindFile) || strings.Contains(l.Name, "|") || strings.Contains(l.Topic, "|") {
+		return ""
+	}
+	return legacyPrefix + "|" + KindFile + "|" + l.Name + "|" + strconv.FormatInt(l.Size, 10) + "|" + l.Hash + "|" + l.Topic + "|/"
+}
+
+//Contains returns whether a text contains a link in either format
+func Contains(text string) bool {
+	return linkStart.MatchString(text)
+}
+
+//Parse parses a single link in either format
+func Parse(link string) (Link, error) {
+	link = strings.TrimSpace(link)
+	if strings.HasPrefix(link, prefix) {
+		return parseURI(link)
+	}
+	if strings.HasPrefix(link, legacyPrefix) {
+		return parseLegacy(link)
+	}
+	return Link{}, errors.New("not a surge link")
+}
+
+//ParseAll parses every link in a text, links that fail to parse are returned as errors next to the links that parsed
+//legacy links of a hash already given in the uri format are skipped, payloads carry both for older peers
+func ParseAll(text string) ([]Link, []error) {
+	links := []Link{}
+	errs := []error{}
+	uriHashes := map[string]bool{}
+
+	starts := linkStart.FindAllStringIndex(text, -1)
+	for i, start := range starts {
+		end := len(text)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		segment := text[start[0]:end]
+
+		//Legacy links end with a slash, links in the uri format at the first character outside the query
+		if strings.HasPrefix(segment, prefix) {
+			if loc := linkEnd.FindStringIndex(segment[len(prefix):]); loc != nil {
+				segment = segment[:len(prefix)+loc[0]]
+			}
+			//A link ending a sentence is followed by a dot, escaped values never end with one
+			segment = strings.TrimRight(segment, ".")
+		} else if last := strings.LastIndex(segment, "|/"); last >= 0 {
+			segment = segment[:last+2]
+		}
+
+		link, err := Parse(segment)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if link.Version > 0 {
+			uriHashes[link.Hash] = true
+		} else if uriHashes[link.Hash] {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links, errs
+}
+
+func parseURI(link string) (Link, error) {
+	query, err := url.ParseQuery(link[len(prefix):])
+	if err != nil {
+		return Link{}, fmt.Errorf("invalid link query: %w", err)
+	}
+
+	//Every parameter but peer is given once
+	for key, values := range query {
+		if key != "peer" && len(values) > 1 {
+			return Link{}, fmt.Errorf("parameter %s given %d times", key, len(values))
+		}
+	}
+
+	version, err := strconv.Atoi(query.Get("v"))
+	if err != nil || version < 1 {
+		return Link{}, errors.New("missing or invalid version")
+	}
+	if version > Version {
+		return Link{}, fmt.Errorf("link version %d is newer than supported version %d", version, Version)
+	}
+
+	xt := query.Get("xt")
+	if !strings.HasPrefix(xt, hashPrefix) {
+		return Link{}, errors.New("missing or invalid xt, expected " + hashPrefix + "<hash>")
+	}
+
+	kind := query.Get("kind")
+	if len(kind) == 0 {
+		kind = KindFile
+	}
+
+	result := Link{
+		Version: version,
+		Kind:    kind,
+		Name:    query.Get("dn"),
+		Hash:    strings.ToLower(strings.TrimPrefix(xt, hashPrefix)),
+		Topic:   query.Get("tp"),
+		Peers:   query["peer"],
+	}
+	result.Size, err = strconv.ParseInt(query.Get("xl"), 10, 64)
+	if err != nil {
+		return Link{}, errors.New("missing or invalid size xl")
+	}
+	return result, validate(result)
+}
+
+func parseLegacy(link string) (Link, error) {
+	fields := strings.Split(link[len(legacyPrefix):], "|")
+
+	//Topic payloads have 7 fields, magnet links an additional seeder
+	if len(fields) != 7 && len(fields) != 8 {
+		return Link{}, fmt.Errorf("legacy link has %d fields, expected 7 or 8", len(fields))
+	}
+	if fields[0] != "" || fields[len(fields)-1] != "/" {
+		return Link{}, errors.New("legacy link is not enclosed by | and |/")
+	}
+
+	result := Link{
+		Version: 0,
+		Kind:    fields[1],
+		Name:    fields[2],
+		Hash:    strings.ToLower(fields[4]),
+		Topic:   fields[len(fields)-2],
+	}
+	if len(fields) == 8 && len(fields[5]) > 0 {
+		result.Peers = []string{fields[5]}
+	}
+
+	var err error
+	result.Size, err = strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return Link{}, errors.New("invalid size " + fields[3])
+	}
+	return result, validate(result)
+}
+
+//ValidateName checks a file or bundle name is a single path element, so it can not be stored outside the download folder
+func ValidateName(name string) error {
+	if len(name) == 0 {
+		return errors.New("missing name")
+	}
+	if name == "." || name == ".." {
+		return errors.New("invalid name " + name)
+	}
+	if strings.ContainsAny(name, "/\\\x00") {
+		return errors.New("name contains a path separator: " + name)
+	}
+	if len(name) >= 2 && name[1] == ':' && isLetter(name[0]) {
+		return errors.New("name has a volume prefix: " + name)
+	}
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func validate(link Link) error {
+	if link.Kind != KindFile && link.Kind != KindPartial && link.Kind != KindBundle {
+		return errors.New("unknown kind " + link.Kind)
+	}
+	if err := ValidateName(link.Name); err != nil {
+		return err
+	}
+	if link.Size <= 0 {
+		return errors.New("size has to be positive")
+	}
+	if strings.HasSuffix(link.Topic, ".") {
+		return errors.New("topic ends with a dot: " + link.Topic)
+	}
+
+	hash, err := hex.DecodeString(link.Hash)
+	if err != nil || len(hash) != 32 {
+		return errors.New("hash is not a hex sha256: " + link.Hash)
+	}
+	for _, peer := range link.Peers {
+		if len(peer) == 0 {
+			return errors.New("empty peer")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package magnet
+
+import (
+	"strings"
+	"testing"
+)
+
+const testHash = "965c013e991ee246d63d45ea71954c4d3a6b1a2b3c4d5e6f708192a3b4c5d6e7"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		link    string
+		want    Link
+		wantErr string
+	}{
+		{
+			name: "uri",
+			link: "surge:?v=1&xt=sha256:" + testHash + "&dn=The+Two+Towers.avi&xl=14997504&tp=surge&peer=abc",
+			want: Link{Version: 1, Kind: KindFile, Name: "The Two Towers.avi", Size: 14997504, Hash: testHash, Topic: "surge", Peers: []string{"abc"}},
+		},
+		{
+			name: "uri with several peers and an unknown parameter",
+			link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a.txt&xl=1&peer=abc&peer=def&future=1",
+			want: Link{Version: 1, Kind: KindFile, Name: "a.txt", Size: 1, Hash: testHash, Peers: []string{"abc", "def"}},
+		},
+		{
+			name: "uri bundle with uppercase hash",
+			link: "surge:?v=1&xt=sha256:" + strings.ToUpper(testHash) + "&dn=photos&xl=10&kind=bundle",
+			want: Link{Version: 1, Kind: KindBundle, Name: "photos", Size: 10, Hash: testHash},
+		},
+		{
+			name: "legacy topic payload",
+			link: "surge://|file|a.txt|42|" + testHash + "|surge|/",
+			want: Link{Kind: KindFile, Name: "a.txt", Size: 42, Hash: testHash, Topic: "surge"},
+		},
+		{
+			name: "legacy magnet link",
+			link: "surge://|file|a.txt|42|" + testHash + "|abc|surge|/",
+			want: Link{Kind: KindFile, Name: "a.txt", Size: 42, Hash: testHash, Topic: "surge", Peers: []string{"abc"}},
+		},
+		{name: "not a link", link: "http://example.com", wantErr: "not a surge link"},
+		{name: "duplicated name", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&dn=b&xl=1", wantErr: "parameter dn given 2 times"},
+		{name: "duplicated size", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&xl=1&xl=2", wantErr: "parameter xl given 2 times"},
+		{name: "missing version", link: "surge:?xt=sha256:" + testHash + "&dn=a&xl=1", wantErr: "missing or invalid version"},
+		{name: "newer version", link: "surge:?v=2&xt=sha256:" + testHash + "&dn=a&xl=1", wantErr: "newer than supported"},
+		{name: "missing hash prefix", link: "surge:?v=1&xt=" + testHash + "&dn=a&xl=1", wantErr: "missing or invalid xt"},
+		{name: "short hash", link: "surge:?v=1&xt=sha256:abcd&dn=a&xl=1", wantErr: "hash is not a hex sha256"},
+		{name: "missing size", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a", wantErr: "missing or invalid size"},
+		{name: "empty file", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&xl=0", wantErr: "size has to be positive"},
+		{name: "unknown kind", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&xl=1&kind=dir", wantErr: "unknown kind dir"},
+		{name: "topic ending with a dot", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&xl=1&tp=surge.", wantErr: "topic ends with a dot"},
+		{name: "empty peer", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=a&xl=1&peer=", wantErr: "empty peer"},
+		{name: "name with a path", link: "surge:?v=1&xt=sha256:" + testHash + "&dn=..%2F..%2F.bashrc&xl=1", wantErr: "path separator"},
+		{name: "legacy with a missing field", link: "surge://|file|a.txt|42|" + testHash + "|/", wantErr: "legacy link has 6 fields"},
+		{name: "legacy without closing", link: "surge://|file|a.txt|42|" + testHash + "|surge|", wantErr: "not enclosed"},
+		{name: "legacy with invalid size", link: "surge://|file|a.txt|big|" + testHash + "|surge|/", wantErr: "invalid size big"},
+		{name: "legacy name with a path", link: "surge://|file|../a.txt|42|" + testHash + "|surge|/", wantErr: "path separator"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Parse(test.link)
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			expectLink(t, got, test.want)
+		})
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	uri := Link{Kind: KindFile, Name: "a b.txt", Size: 42, Hash: testHash, Topic: "surge"}.String()
+	otherHash := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name       string
+		text       string
+		wantHashes []string
+		wantErrs   int
+	}{
+		{name: "link ending a sentence", text: "get " + uri + ".", wantHashes: []string{testHash}},
+		{name: "links separated by spaces", text: uri + " surge://|file|b.txt|1|" + otherHash + "|surge|/", wantHashes: []string{testHash, otherHash}},
+		{name: "payload with uri and legacy line", text: uri + "\nsurge://|file|a b.txt|42|" + testHash + "|surge|/", wantHashes: []string{testHash}},
+		{name: "legacy line before uri of another hash", text: "surge://|file|b.txt|1|" + otherHash + "|surge|/" + uri, wantHashes: []string{otherHash, testHash}},
+		{name: "invalid link next to a valid one", text: "surge:?v=1&dn=a " + uri, wantHashes: []string{testHash}, wantErrs: 1},
+		{name: "no links", text: "nothing to see"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			links, errs := ParseAll(test.text)
+			if len(errs) != test.wantErrs {
+				t.Fatalf("got %d errors %v, want %d", len(errs), errs, test.wantErrs)
+			}
+			if len(links) != len(test.wantHashes) {
+				t.Fatalf("got %d links %v, want %d", len(links), links, len(test.wantHashes))
+			}
+			for i, hash := range test.wantHashes {
+				if links[i].Hash != hash {
+					t.Fatalf("link %d has hash %s, want %s", i, links[i].Hash, hash)
+				}
+			}
+		})
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	links := []Link{
+		{Version: 1, Kind: KindFile, Name: "a & b=c?.txt", Size: 1, Hash: testHash, Topic: "my topic", Peers: []string{"abc", "def"}},
+		{Version: 1, Kind: KindPartial, Name: "a.txt", Size: 1 << 40, Hash: testHash},
+		{Version: 1, Kind: KindBundle, Name: "photos", Size: 3, Hash: testHash, Topic: "surge"},
+	}
+
+	for _, link := range links {
+		got, err := Parse(link.String())
+		if err != nil {
+			t.Fatalf("%s does not parse: %v", link.String(), err)
+		}
+		expectLink(t, got, link)
+	}
+}
+
+func TestLegacyString(t *testing.T) {
+	tests := []struct {
+		name string
+		link Link
+		want string
+	}{
+		{name: "file", link: Link{Kind: KindFile, Name: "a.txt", Size: 42, Hash: testHash, Topic: "surge"}, want: "surge://|file|a.txt|42|" + testHash + "|surge|/"},
+		{name: "partial", link: Link{Kind: KindPartial, Name: "a.txt", Size: 42, Hash: testHash, Topic: "surge"}},
+		{name: "pipe in name", link: Link{Kind: KindFile, Name: "a|b.txt", Size: 42, Hash: testHash, Topic: "surge"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.link.LegacyString(); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "movie.mkv", valid: true},
+		{name: "..hidden", valid: true},
+		{name: "ab:c", valid: true},
+		{name: "a:b"},
+		{name: ""},
+		{name: "."},
+		{name: ".."},
+		{name: "dir/file"},
+		{name: "dir\\file"},
+		{name: "file\x00.txt"},
+		{name: "C:file"},
+		{name: "c:"},
+	}
+
+	for _, test := range tests {
+		err := ValidateName(test.name)
+		if (err == nil) != test.valid {
+			t.Fatalf("ValidateName(%q) = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func expectLink(t *testing.T, got Link, want Link) {
+	t.Helper()
+
+	if got.Version != want.Version || got.Kind != want.Kind || got.Name != want.Name || got.Size != want.Size || got.Hash != want.Hash || got.Topic != want.Topic {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if strings.Join(got.Peers, ",") != strings.Join(want.Peers, ",") {
+		t.Fatalf("got peers %v, want %v", got.Peers, want.Peers)
+	}
+}
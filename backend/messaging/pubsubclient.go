@@ -10,18 +10,23 @@ import (
 var nknClient *nkn.MultiClient
 var nknAccount *nkn.Account
 var onMessageHandler func(*MessageReceivedObj)
+var sessionAddress string
 
-//Initializes provides client with required nkn objects
-func Initialize(client *nkn.MultiClient, account *nkn.Account, onMsgHandler func(*MessageReceivedObj)) {
+//Initializes provides client with required nkn objects and the address we accept sessions on, announced in every message
+func Initialize(client *nkn.MultiClient, account *nkn.Account, localSessionAddress string, onMsgHandler func(*MessageReceivedObj)) {
 	nknClient = client
 	nknAccount = account
 	onMessageHandler = onMsgHandler
+	if localSessionAddress != client.Addr().String() {
+		sessionAddress = localSessionAddress
+	}
 
 	go listen()
 }
 
 //Broadcast sends a message to all subscribers
 func Broadcast(msg *MessageObj) {
+	msg.SessionAddress = sessionAddress
 	jsonObj, err := json.Marshal(msg)
 	if err != nil {
 		log.Println("Broadcast json marshal:", err)
@@ -36,6 +41,7 @@ func Broadcast(msg *MessageObj) {
 }
 
 func (msgReceived MessageReceivedObj) Reply(msg *MessageObj) {
+	msg.SessionAddress = sessionAddress
 	jsonObj, err := json.Marshal(msg)
 
 	if err != nil {
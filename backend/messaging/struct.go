@@ -1,16 +1,18 @@
 package messaging
 
 type MessageObj struct {
-	Type         int
-	TopicEncoded string
-	Data         []byte
+	Type           int
+	TopicEncoded   string
+	Data           []byte
+	SessionAddress string `json:",omitempty"` //address the sender accepts sessions on when it is not its nkn address
 }
 
 type MessageReceivedObj struct {
-	Type         int
-	TopicEncoded string
-	Data         []byte
-	Sender       string
+	Type           int
+	TopicEncoded   string
+	Data           []byte
+	SessionAddress string //address the sender announced to open sessions on, unconfirmed until a session handshake with the sender
+	Sender         string
 }
 
 //Message Types
@@ -0,0 +1,223 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the .surge metadata files
+	A .surge file describes a listing like a magnet link, it also carries the chunk hashes of a file or the manifest of a bundle,
+	a description and the publisher. It is signed by the publisher account so it can be archived and shared out-of-band.
+	Importing a .surge file lists it, asks the publisher for it and starts the download.
+*/
+
+package surge
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/magnet"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+)
+
+//Version of the .surge files we write and the highest we read
+const metadataVersion = 1
+
+//ExportMetadata writes a .surge file signed by our account describing a local file or bundle
+func ExportMetadata(Hash string, Path string, Description string) bool {
+	metadataBytes, err := exportMetadata(Hash, Description)
+	if err != nil {
+		pushError("Error on export metadata", err.Error())
+		return false
+	}
+
+	err = ioutil.WriteFile(Path, metadataBytes, 0644)
+	if err != nil {
+		pushError("Error on export metadata", err.Error())
+		return false
+	}
+
+	pushNotification("Metadata Exported", Path)
+	return true
+}
+
+//GetMetadata returns the contents of a .surge file signed by our account describing a local file or bundle, empty when there is no such file
+func GetMetadata(Hash string, Description string) string {
+	metadataBytes, err := exportMetadata(Hash, Description)
+	if err != nil {
+		pushError("Error on export metadata", err.Error())
+		return ""
+	}
+	return string(metadataBytes)
+}
+
+// returns a signed .surge file describing a local file or bundle
+func exportMetadata(hash string, description string) ([]byte, error) {
+	metadata, err := buildMetadata(hash, description)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := client.Account().Seed()
+	signMetadata(metadata, ed25519.NewKeyFromSeed(seed))
+
+	return json.MarshalIndent(metadata, "", "  ")
+}
+
+//ImportMetadata reads a .surge file, lists the file or bundle it describes and starts the download from its publisher
+func ImportMetadata(Path string) bool {
+	metadataBytes, err := ioutil.ReadFile(Path)
+	if err != nil {
+		pushError("Error on import metadata", err.Error())
+		return false
+	}
+
+	return ImportMetadataContents(string(metadataBytes))
+}
+
+//ImportMetadataContents imports the contents of a .surge file like ImportMetadata
+func ImportMetadataContents(Contents string) bool {
+	metadata := &models.Metadata{}
+	err := json.Unmarshal([]byte(Contents), metadata)
+	if err != nil {
+		pushError("Error on import metadata", "not a .surge file: "+err.Error())
+		return false
+	}
+
+	err = verifyMetadata(metadata)
+	if err != nil {
+		pushError("Error on import metadata", err.Error())
+		return false
+	}
+
+	listing := models.File{
+		FileName:  metadata.Name,
+		FileSize:  metadata.Size,
+		FileHash:  metadata.Hash,
+		NumChunks: int((metadata.Size-1)/int64(constants.ChunkSize)) + 1,
+		Topic:     metadata.Topic,
+		IsBundle:  metadata.Kind == magnet.KindBundle,
+	}
+
+	//A manifest is bound to the bundle hash, what the publisher signed spares us fetching it from seeders
+	if listing.IsBundle {
+		bundleManifestLock.Lock()
+		bundleManifestMap[metadata.Hash] = metadata.Manifest
+		bundleManifestLock.Unlock()
+	} else if len(metadata.ChunkHashes) > 0 && getChunkHashes(metadata.Hash) == nil {
+		//Anyone can sign chunk hashes for a file hash, they only count as the offer of the publisher until seeders agree
+		if offerChunkHashes(metadata.Hash, metadata.Publisher, metadata.ChunkHashes) {
+			setChunkHashes(metadata.Hash, metadata.ChunkHashes)
+		}
+	}
+
+	ListedFiles.Add(listing)
+	if len(metadata.Peer) > 0 {
+		sessionmanager.SetPeerAddress(metadata.Publisher, metadata.Peer)
+	}
+	addPeerHints(metadata.Hash, []string{metadata.Publisher}, listing.IsBundle)
+
+	pushNotification("Metadata Imported", metadata.Name)
+	go DownloadFileByHash(metadata.Hash)
+	return true
+}
+
+// describes a local file or bundle, unsigned
+func buildMetadata(hash string, description string) (*models.Metadata, error) {
+	metadata := &models.Metadata{
+		Version:     metadataVersion,
+		Hash:        hash,
+		Publisher:   hex.EncodeToString(client.Account().PubKey()),
+		Created:     time.Now().Unix(),
+		Description: description,
+	}
+	if sessionAddress := GetSessionAddress(); sessionAddress != metadata.Publisher {
+		metadata.Peer = sessionAddress
+	}
+
+	bundle, err := dbGetBundle(hash)
+	if err == nil {
+		manifest, err := parseBundleManifest(bundle.Manifest)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Kind = magnet.KindBundle
+		metadata.Name = manifest.Name
+		metadata.Size = bundleSize(manifest)
+		metadata.Topic = bundle.Topic
+		metadata.Manifest = bundle.Manifest
+		return metadata, nil
+	}
+
+	file, err := dbGetFile(hash)
+	if err != nil {
+		return nil, errors.New("no local file or bundle with hash " + hash)
+	}
+	if file.IsHashing || file.IsDownloading {
+		return nil, errors.New(file.FileName + " is not fully available yet")
+	}
+	metadata.Kind = magnet.KindFile
+	metadata.Name = file.FileName
+	metadata.Size = file.FileSize
+	metadata.Topic = file.Topic
+	metadata.ChunkHashes = getChunkHashes(hash)
+	return metadata, nil
+}
+
+// returns the bytes the signature covers, the metadata json without signature
+func metadataSigningBytes(metadata models.Metadata) []byte {
+	metadata.Signature = nil
+	signingBytes, _ := json.Marshal(metadata)
+	return signingBytes
+}
+
+func signMetadata(metadata *models.Metadata, privateKey ed25519.PrivateKey) {
+	metadata.Signature = ed25519.Sign(privateKey, metadataSigningBytes(*metadata))
+}
+
+// checks a .surge file is complete, consistent and signed by its publisher
+func verifyMetadata(metadata *models.Metadata) error {
+	if metadata.Version < 1 || metadata.Version > metadataVersion {
+		return fmt.Errorf("unsupported .surge file version %d", metadata.Version)
+	}
+	if metadata.Kind != magnet.KindFile && metadata.Kind != magnet.KindBundle {
+		return errors.New("unknown kind " + metadata.Kind)
+	}
+	//The signature proves who wrote the file, not that its name is safe to download to
+	if err := magnet.ValidateName(metadata.Name); err != nil {
+		return err
+	}
+	if metadata.Size <= 0 {
+		return errors.New("size has to be positive")
+	}
+	hash, err := hex.DecodeString(metadata.Hash)
+	if err != nil || len(hash) != sha256.Size {
+		return errors.New("hash is not a hex sha256: " + metadata.Hash)
+	}
+
+	publicKey, err := hex.DecodeString(metadata.Publisher)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return errors.New("invalid publisher key")
+	}
+	if !ed25519.Verify(publicKey, metadataSigningBytes(*metadata), metadata.Signature) {
+		return errors.New("signature does not match the publisher")
+	}
+
+	if metadata.Kind == magnet.KindBundle {
+		_, err := verifyBundleManifest(metadata.Hash, metadata.Manifest)
+		return err
+	}
+
+	numChunks := int((metadata.Size-1)/int64(constants.ChunkSize)) + 1
+	if len(metadata.ChunkHashes) > 0 && len(metadata.ChunkHashes) != numChunks*sha256.Size {
+		return errors.New("chunk hashes do not match the file size")
+	}
+	return nil
+}
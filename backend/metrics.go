@@ -0,0 +1,146 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the metrics endpoint
+	Counters and gauges of the node are served in the prometheus text format so always-on nodes can be monitored
+*/
+
+package surge
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rule110-io/surge/backend/mutexes"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+)
+
+//Counters only ever go up, they are read and written atomically
+var metricBytesDownloaded int64
+var metricBytesUploaded int64
+var metricChunksReceived int64
+var metricChunksCorrupt int64
+var metricChunkTimeouts int64
+var metricChunkRequeues int64
+
+//A sample of a metric with its labels
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+//StartMetrics serves the metrics on the given address at /metrics, this blocks until the listener fails
+func StartMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+
+	log.Println("Metrics listening on", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "surge_bytes_downloaded_total", "counter", "Bytes received from peers.", metricSample{value: float64(atomic.LoadInt64(&metricBytesDownloaded))})
+	writeMetric(w, "surge_bytes_uploaded_total", "counter", "Bytes sent to peers.", metricSample{value: float64(atomic.LoadInt64(&metricBytesUploaded))})
+	writeMetric(w, "surge_chunks_received_total", "counter", "Chunks received intact.", metricSample{value: float64(atomic.LoadInt64(&metricChunksReceived))})
+	writeMetric(w, "surge_chunks_corrupt_total", "counter", "Chunks received that failed verification.", metricSample{value: float64(atomic.LoadInt64(&metricChunksCorrupt))})
+	writeMetric(w, "surge_chunk_timeouts_total", "counter", "Chunk requests that timed out.", metricSample{value: float64(atomic.LoadInt64(&metricChunkTimeouts))})
+	writeMetric(w, "surge_chunk_requeues_total", "counter", "Chunks requeued to be requested again.", metricSample{value: float64(atomic.LoadInt64(&metricChunkRequeues))})
+
+	writeMetric(w, "surge_sessions", "gauge", "Open sessions with peers.", metricSample{value: float64(sessionmanager.GetSessionLength())})
+	writeMetric(w, "surge_chunks_in_transit", "gauge", "Chunks requested and not yet received.", metricSample{value: float64(countChunksInTransit())})
+
+	uploadStatus := GetUploadStatus()
+	writeMetric(w, "surge_upload_slots_active", "gauge", "Upload slots transmitting a chunk.", metricSample{value: float64(uploadStatus.ActiveSlots)})
+	writeMetric(w, "surge_upload_queue_depth", "gauge", "Chunk requests waiting for an upload slot.", metricSample{value: float64(uploadStatus.QueueDepth)})
+
+	active, queued := 0, 0
+	for _, download := range GetDownloadQueue() {
+		if download.IsActive {
+			active++
+		} else {
+			queued++
+		}
+	}
+	writeMetric(w, "surge_downloads_active", "gauge", "Downloads transferring.", metricSample{value: float64(active)})
+	writeMetric(w, "surge_downloads_queued", "gauge", "Downloads waiting in the queue.", metricSample{value: float64(queued)})
+
+	writeMetric(w, "surge_topic_subscription_state", "gauge", "Subscription state per topic, 0 unknown, 1 pending, 2 subscribed.", topicStateSamples()...)
+	writeMetric(w, "surge_file_seeders", "gauge", "Known seeders per local file.", fileSeederSamples()...)
+}
+
+// writes a metric with its help and type lines
+func writeMetric(w http.ResponseWriter, name string, kind string, help string, samples ...metricSample) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, sample := range samples {
+		fmt.Fprintf(w, "%s%s %v\n", name, formatLabels(sample.labels), sample.value)
+	}
+}
+
+// formats labels sorted by key, empty when there are none
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := []string{}
+	for _, key := range keys {
+		pairs = append(pairs, key+`="`+escaper.Replace(labels[key])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func countChunksInTransit() int {
+	mutexes.ChunkInTransitLock.Lock()
+	defer mutexes.ChunkInTransitLock.Unlock()
+
+	count := 0
+	for _, inTransit := range chunksInTransit {
+		if inTransit {
+			count++
+		}
+	}
+	return count
+}
+
+func topicStateSamples() []metricSample {
+	mutexes.TopicsMapLock.Lock()
+	defer mutexes.TopicsMapLock.Unlock()
+
+	samples := []metricSample{}
+	for _, topic := range topicsMap {
+		samples = append(samples, metricSample{
+			labels: map[string]string{"topic": topic.Name},
+			value:  float64(topicEncodedSubcribeStateMap[topic.NameEncoded]),
+		})
+	}
+	return samples
+}
+
+func fileSeederSamples() []metricSample {
+	samples := []metricSample{}
+	for _, file := range dbGetAllFiles() {
+		if file.IsHashing {
+			continue
+		}
+		samples = append(samples, metricSample{
+			labels: map[string]string{"hash": file.FileHash},
+			value:  float64(len(GetSeeders(file.FileHash))),
+		})
+	}
+	return samples
+}
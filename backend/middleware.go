@@ -2,6 +2,7 @@ package surge
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 
@@ -17,13 +18,74 @@ import (
 type MiddlewareFunctions struct {
 }
 
+//APIMethods are the middleware functions served on the control api
+//seeding reads the given paths with the permissions of the node, removing a file can delete it from disk and bandwidth caps can be changed,
+//functions that open dialogs, read or write other paths, change other settings or hooks or spend from the wallet are left to the app
+var APIMethods = []string{
+	"GetLocalFiles",
+	"GetRemoteFiles",
+	"SearchRemoteFiles",
+	"SearchNetwork",
+	"DownloadFile",
+	"SetDownloadPause",
+	"SetChunkStrategy",
+	"GetPublicKey",
+	"GetFileChunkMap",
+	"SeedFilePath",
+	"SeedDirectoryPath",
+	"GetBundleManifest",
+	"DownloadBundle",
+	"SetFileRateLimit",
+	"SetGlobalRateLimits",
+	"GetUploadStatus",
+	"GetDownloadQueue",
+	"SetDownloadPriority",
+	"MoveQueuedDownload",
+	"GetMetadata",
+	"ImportMetadataContents",
+	"GetHooks",
+	"GetHookLog",
+	"ReloadHooks",
+	"RemoveFile",
+	"StartDownloadMagnetLinks",
+	"SubscribeToTopic",
+	"UnsubscribeFromTopic",
+	"GetTopicSubscriptions",
+	"GetFileDetails",
+	"GetTopicDetails",
+	"GetOfficialTopicName",
+	"GetWalletAddress",
+	"GetWalletBalance",
+	"GetTxFee",
+}
+
 func (s *MiddlewareFunctions) GetLocalFiles(Query string, filterState FileFilterState, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryResult {
 	return SearchLocalFile(Query, filterState, OrderBy, IsDesc, Skip, Take)
 }
 
 //GetRemoteFiles gets remote files
 func (s *MiddlewareFunctions) GetRemoteFiles(Topic string, Query string, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryRemoteResult {
-	return SearchRemoteFile(Topic, Query, OrderBy, IsDesc, Skip, Take)
+	return SearchRemoteFile(Topic, Query, models.ListingFilter{}, OrderBy, IsDesc, Skip, Take)
+}
+
+//SearchRemoteFiles searches remote files of a topic, or of all subscribed topics when Topic is empty, OrderBy can also be Relevance
+func (s *MiddlewareFunctions) SearchRemoteFiles(Topic string, Query string, Filter models.ListingFilter, OrderBy string, IsDesc bool, Skip int, Take int) PagedQueryRemoteResult {
+	return SearchRemoteFile(Topic, Query, Filter, OrderBy, IsDesc, Skip, Take)
+}
+
+//SearchNetwork asks the peers of a topic, or of all subscribed topics when Topic is empty, for files matching the query
+//matches arrive over the next seconds and are searched like announced files
+func (s *MiddlewareFunctions) SearchNetwork(Topic string, Query string) bool {
+	topics := []string{Topic}
+	if len(Topic) == 0 {
+		topics = getSubscribedTopicNames()
+	}
+
+	success := len(topics) > 0
+	for _, topic := range topics {
+		success = BroadcastSearchQuery(topic, Query) && success
+	}
+	return success
 }
 
 //DownloadFile download file by hash
@@ -36,6 +98,11 @@ func (s *MiddlewareFunctions) SetDownloadPause(Hashes []string, State bool) {
 	SetFilePause(Hashes, State)
 }
 
+//SetChunkStrategy sets the chunk download order of a file, sequential, random or rarest
+func (s *MiddlewareFunctions) SetChunkStrategy(Hash string, Strategy string) bool {
+	return SetFileChunkStrategy(Hash, Strategy)
+}
+
 //GetPublicKey retrieves account pubkey
 func (s *MiddlewareFunctions) GetPublicKey() string {
 	return GetAccountAddress()
@@ -70,6 +137,10 @@ func (s *MiddlewareFunctions) OpenFolder(Hash string) {
 }
 
 func (s *MiddlewareFunctions) SeedFile(Topic string) bool {
+	if wailsContext == nil {
+		pushError("Seed File Error", "no file dialog available in headless mode, use SeedFilePath.")
+		return false
+	}
 	path, _ := runtime.OpenFileDialog(*wailsContext, runtime.OpenDialogOptions{
 		Title: "Select File",
 	})
@@ -79,6 +150,110 @@ func (s *MiddlewareFunctions) SeedFile(Topic string) bool {
 	return SeedFilepath(path, Topic)
 }
 
+//SeedFilePath seeds the file at the given path, headless equivalent of SeedFile
+func (s *MiddlewareFunctions) SeedFilePath(Path string, Topic string) bool {
+	if !FileExists(Path) {
+		pushError("Seed File Error", "no file found at "+Path)
+		return false
+	}
+	return SeedFilepath(Path, Topic)
+}
+
+//SeedDirectory seeds a directory picked in a dialog as a single bundle
+func (s *MiddlewareFunctions) SeedDirectory(Topic string) bool {
+	if wailsContext == nil {
+		pushError("Seed Directory Error", "no directory dialog available in headless mode, use SeedDirectoryPath.")
+		return false
+	}
+	path, _ := runtime.OpenDirectoryDialog(*wailsContext, runtime.OpenDialogOptions{
+		Title: "Select Directory",
+	})
+	if path == "" {
+		return false
+	}
+	return SeedDirectory(path, Topic)
+}
+
+//SeedDirectoryPath seeds the directory at the given path as a single bundle, headless equivalent of SeedDirectory
+func (s *MiddlewareFunctions) SeedDirectoryPath(Path string, Topic string) bool {
+	return SeedDirectory(Path, Topic)
+}
+
+//GetBundleManifest returns the files of a bundle so a subset can be picked for download
+func (s *MiddlewareFunctions) GetBundleManifest(Hash string) []models.BundleFile {
+	return GetBundleManifest(Hash)
+}
+
+//DownloadBundle downloads the files of a bundle at the given relative paths, all files when Paths is empty
+func (s *MiddlewareFunctions) DownloadBundle(Hash string, Paths []string) bool {
+	return DownloadBundle(Hash, Paths)
+}
+
+//SetFileRateLimit sets the download and upload caps of a file in bytes per second, 0 is unlimited
+func (s *MiddlewareFunctions) SetFileRateLimit(Hash string, DownloadLimit int64, UploadLimit int64) bool {
+	return SetFileRateLimit(Hash, DownloadLimit, UploadLimit)
+}
+
+//SetGlobalRateLimits sets the download and upload caps for all files in bytes per second, 0 is unlimited
+func (s *MiddlewareFunctions) SetGlobalRateLimits(DownloadLimit int64, UploadLimit int64) bool {
+	return SetGlobalRateLimits(DownloadLimit, UploadLimit)
+}
+
+//GetUploadStatus returns the upload slots in use, the request queue depth and which peers are choked
+func (s *MiddlewareFunctions) GetUploadStatus() UploadStatus {
+	return GetUploadStatus()
+}
+
+//GetDownloadQueue returns the active downloads followed by the queued downloads in order
+func (s *MiddlewareFunctions) GetDownloadQueue() []QueuedDownload {
+	return GetDownloadQueue()
+}
+
+//SetDownloadPriority sets the priority of a download, high, normal or low
+func (s *MiddlewareFunctions) SetDownloadPriority(Hash string, Priority string) bool {
+	return SetDownloadPriority(Hash, Priority)
+}
+
+//MoveQueuedDownload moves a queued download to a position in the queue, 0 is next
+func (s *MiddlewareFunctions) MoveQueuedDownload(Hash string, Position int) bool {
+	return MoveQueuedDownload(Hash, Position)
+}
+
+//ExportMetadata writes a .surge file describing a local file or bundle, signed by our account, the Description is optional
+func (s *MiddlewareFunctions) ExportMetadata(Hash string, Path string, Description string) bool {
+	return ExportMetadata(Hash, Path, Description)
+}
+
+//ImportMetadata reads a .surge file and starts downloading the file or bundle it describes from its publisher
+func (s *MiddlewareFunctions) ImportMetadata(Path string) bool {
+	return ImportMetadata(Path)
+}
+
+//GetMetadata returns a .surge file describing a local file or bundle, signed by our account, the Description is optional
+func (s *MiddlewareFunctions) GetMetadata(Hash string, Description string) string {
+	return GetMetadata(Hash, Description)
+}
+
+//ImportMetadataContents starts downloading the file or bundle the given .surge file contents describe from its publisher
+func (s *MiddlewareFunctions) ImportMetadataContents(Contents string) bool {
+	return ImportMetadataContents(Contents)
+}
+
+//GetHooks returns the hooks run on download, seed, listing and topic events
+func (s *MiddlewareFunctions) GetHooks() []models.Hook {
+	return GetHooks()
+}
+
+//ReloadHooks reads the hooks file in the surge dir again after it was edited
+func (s *MiddlewareFunctions) ReloadHooks() bool {
+	return ReloadHooks()
+}
+
+//GetHookLog returns the most recent hook executions
+func (s *MiddlewareFunctions) GetHookLog() []models.HookExecution {
+	return GetHookLog()
+}
+
 //RemoveFile remove file from surge (and os) by hash
 func (s *MiddlewareFunctions) RemoveFile(Hash string, FromDisk bool) bool {
 	return RemoveFileByHash(Hash, FromDisk)
@@ -87,6 +262,16 @@ func (s *MiddlewareFunctions) RemoveFile(Hash string, FromDisk bool) bool {
 //WriteSetting generic kvs setting store
 func (s *MiddlewareFunctions) WriteSetting(Key string, Value string) bool {
 	err := DbWriteSetting(Key, Value)
+
+	//Bandwidth caps and upload slots apply at runtime
+	switch Key {
+	case "downloadLimit", "uploadLimit":
+		applyRateLimitSettings()
+	case "uploadSlots":
+		applyUploadSlotSettings()
+	case "maxActiveDownloads":
+		scheduleDownloads()
+	}
 	return err != nil
 }
 
@@ -99,11 +284,7 @@ func (s *MiddlewareFunctions) ReadSetting(Key string) string {
 //StartDownloadMagnetLinks initiate a download by magnet
 func (s *MiddlewareFunctions) StartDownloadMagnetLinks(Magnetlinks string) bool {
 	//need to parse Magnetlinks array and download all of them
-	files := ParsePayloadString(Magnetlinks)
-	for i := 0; i < len(files); i++ {
-		go DownloadFileByHash(files[i].FileHash)
-	}
-	return true
+	return startDownloadMagnetLinks(Magnetlinks)
 }
 
 //SubscribeToTopic subscribes to given topic
@@ -130,21 +311,30 @@ func (s *MiddlewareFunctions) GetTopicSubscriptions() []models.TopicInfo {
 }
 
 type FileDetails struct {
-	FileID           string
-	Seeders          []SeederDetails
-	NumChunks        int
-	ChunksDownloaded int
-	ChunksShared     int
-	BytesDownloaded  int64
-	BytesUploaded    int64
-	DateTimeAdded    int64
+	FileID              string
+	Seeders             []SeederDetails
+	NumChunks           int
+	ChunksDownloaded    int
+	ChunksShared        int
+	BytesDownloaded     int64
+	BytesUploaded       int64
+	DateTimeAdded       int64
+	ChunkStrategy       string
+	Priority            string
+	DownloadLimit       int64
+	UploadLimit         int64
+	GlobalDownloadLimit int64
+	GlobalUploadLimit   int64
 }
 
 type SeederDetails struct {
-	PublicKey     string
-	Workers       int
-	ActiveSession bool
-	LastActivity  int64
+	PublicKey       string
+	Workers         int
+	ActiveSession   bool
+	LastActivity    int64
+	ProtocolVersion int
+	ClientVersion   string
+	Stats           SeederStats
 }
 
 func (s *MiddlewareFunctions) GetFileDetails(FileHash string) FileDetails {
@@ -178,23 +368,40 @@ func (s *MiddlewareFunctions) GetFileDetails(FileHash string) FileDetails {
 			lastActivity = session.LastActivityUnix
 		}
 
+		//Peers without a hello run the legacy protocol
+		hello, helloReceived := GetPeerHello(v)
+		if !helloReceived {
+			hello.ProtocolVersion = constants.LegacyProtocolVersion
+		}
+
 		seederDetails = append(seederDetails, SeederDetails{
-			PublicKey:     v,
-			Workers:       workerCount,
-			ActiveSession: sessionActive,
-			LastActivity:  lastActivity,
+			PublicKey:       v,
+			Workers:         workerCount,
+			ActiveSession:   sessionActive,
+			LastActivity:    lastActivity,
+			ProtocolVersion: hello.ProtocolVersion,
+			ClientVersion:   hello.ClientVersion,
+			Stats:           GetSeederStats(v),
 		})
 	}
 
+	globalDownLimit, globalUpLimit := GetGlobalRateLimits()
+
 	return FileDetails{
-		FileID:           file.FileHash,
-		Seeders:          seederDetails,
-		NumChunks:        file.NumChunks,
-		ChunksDownloaded: chunksDownloaded,
-		ChunksShared:     file.ChunksShared,
-		BytesDownloaded:  byteDown,
-		BytesUploaded:    byteUp,
-		DateTimeAdded:    file.DateTimeAdded,
+		FileID:              file.FileHash,
+		Seeders:             seederDetails,
+		NumChunks:           file.NumChunks,
+		ChunksDownloaded:    chunksDownloaded,
+		ChunksShared:        file.ChunksShared,
+		BytesDownloaded:     byteDown,
+		BytesUploaded:       byteUp,
+		DateTimeAdded:       file.DateTimeAdded,
+		ChunkStrategy:       file.ChunkStrategy,
+		Priority:            getDownloadPriority(file.FileHash),
+		DownloadLimit:       file.DownloadLimit,
+		UploadLimit:         file.UploadLimit,
+		GlobalDownloadLimit: globalDownLimit,
+		GlobalUploadLimit:   globalUpLimit,
 	}
 }
 func (s *MiddlewareFunctions) GetTopicDetails(Topic string) models.TopicInfo {
@@ -206,6 +413,10 @@ func (s *MiddlewareFunctions) GetOfficialTopicName() string {
 }
 
 func (s *MiddlewareFunctions) SetDownloadFolder() bool {
+	if wailsContext == nil {
+		pushError("Error on set download folder", "no folder dialog available in headless mode, use SetDownloadFolderPath.")
+		return false
+	}
 	path, _ := runtime.OpenDirectoryDialog(*wailsContext, runtime.OpenDialogOptions{
 		Title: "Select Download Folder",
 	})
@@ -216,6 +427,17 @@ func (s *MiddlewareFunctions) SetDownloadFolder() bool {
 	return true
 }
 
+//SetDownloadFolderPath sets the download folder to the given path, headless equivalent of SetDownloadFolder
+func (s *MiddlewareFunctions) SetDownloadFolderPath(Path string) bool {
+	info, err := os.Stat(Path)
+	if err != nil || !info.IsDir() {
+		pushError("Error on set download folder", "no folder found at "+Path)
+		return false
+	}
+	DbWriteSetting("downloadFolder", Path)
+	return true
+}
+
 func (s *MiddlewareFunctions) GetWalletAddress() string {
 	return WalletAddress()
 }
@@ -0,0 +1,27 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	Model for Bundle
+	A Bundle describes a seeded directory, listed as a single entry with a manifest of the files in it
+*/
+
+package models
+
+type BundleFile struct {
+	Path     string //relative to the bundle root, slash separated
+	FileSize int64
+	FileHash string
+}
+
+type BundleManifest struct {
+	Name  string
+	Files []BundleFile
+}
+
+type Bundle struct {
+	BundleHash string //sha256 of the manifest json
+	Topic      string
+	Manifest   []byte //manifest json exactly as hashed
+}
@@ -27,4 +27,12 @@ type File struct {
 	Progress      float32 //only for remote
 	Topic         string
 	DateTimeAdded int64
+	ChunkStrategy string   //only for local, order in which chunks are downloaded
+	DownloadLimit int64    //only for local, bytes per second, 0 is unlimited
+	UploadLimit   int64    //only for local, bytes per second, 0 is unlimited
+	Priority      string   //only for local, where the download is placed in the queue
+	QueuePosition int      //only for local, position in the download queue
+	IsBundle      bool     //only for remote, listing of a seeded directory
+	BundleHash    string   //only for local, bundle the file is part of
+	PeerHints     []string //seeders named by the magnet link, asked for chunks even when the file is not announced in a topic
 }
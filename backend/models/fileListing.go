@@ -10,4 +10,8 @@ type FileListing struct {
 	IsTracked     bool
 	IsDownloading bool
 	IsUploading   bool
+	IsBundle      bool
+	FirstSeen     int64   //unix seconds the listing was first announced
+	LastSeen      int64   //unix seconds the listing was last announced
+	Relevance     float64 //how well the listing matches the search query, higher is better
 }
@@ -0,0 +1,16 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	Model for Hello
+	A Hello is exchanged by both peers when a session opens, it tells which protocol and features the peer speaks
+*/
+
+package models
+
+type Hello struct {
+	ProtocolVersion int
+	ClientVersion   string
+	Features        []string
+}
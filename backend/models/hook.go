@@ -0,0 +1,43 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	Model for Hook
+	A Hook runs an executable or posts to a webhook when a lifecycle event is emitted
+*/
+
+package models
+
+type Hook struct {
+	ID     string
+	Event  string //name of the event, e.g. downloadFinished
+	Type   string //exec or webhook
+	Target string //path of the executable or url of the webhook
+}
+
+//HookPayload is posted to webhooks as json and passed to executables as environment variables
+type HookPayload struct {
+	Event    string
+	Time     int64
+	FileHash string `json:",omitempty"`
+	FileName string `json:",omitempty"`
+	FileSize int64  `json:",omitempty"`
+	Path     string `json:",omitempty"`
+	Topic    string `json:",omitempty"`
+	State    int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+//HookExecution is an attempt to run a hook
+type HookExecution struct {
+	HookID   string
+	Event    string
+	Target   string
+	Attempt  int
+	Success  bool
+	Error    string
+	Output   string //output of executables, response of webhooks, truncated
+	Time     int64
+	Duration int64 //milliseconds
+}
@@ -0,0 +1,9 @@
+package models
+
+//ListingFilter narrows down a search of remote files, zero values do not filter
+type ListingFilter struct {
+	Extensions []string //file extensions without dot, bundles have none
+	MinSize    int64    //bytes
+	MaxSize    int64    //bytes
+	MinSeeders int
+}
@@ -0,0 +1,26 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	Model for Metadata
+	The content of a .surge file, a listing that can be shared without a topic, signed by its publisher
+*/
+
+package models
+
+type Metadata struct {
+	Version     int
+	Kind        string //file or bundle
+	Name        string
+	Size        int64
+	Hash        string //hex sha256 of the file, of the manifest for bundles
+	Topic       string
+	Publisher   string //hex public key of the publishing account, also its address
+	Peer        string `json:",omitempty"` //address to open sessions with the publisher on when it is not the publisher key
+	Created     int64  //unix seconds
+	Description string `json:",omitempty"`
+	ChunkHashes []byte `json:",omitempty"` //sha256 per chunk concatenated in chunk order, only for files
+	Manifest    []byte `json:",omitempty"` //manifest json exactly as hashed, only for bundles
+	Signature   []byte `json:",omitempty"` //ed25519 signature of the publisher over the metadata without signature
+}
@@ -19,9 +19,6 @@ var ChunkInTransitLock = &sync.Mutex{}
 // Mutex for reading or mutating the File model
 var FileWriteLock = &sync.Mutex{}
 
-// Mutex for reading or mutating the ListedFiles collection
-var ListedFilesLock = &sync.Mutex{}
-
 var WorkerMapLock = &sync.Mutex{}
 // Mutex for reading or mutating the TopicsMap collection
 var TopicsMapLock = &sync.Mutex{}
@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	bitmap "github.com/boljen/go-bitmap"
@@ -30,6 +31,9 @@ var zeroBandwidthMap map[string]bool
 
 var chunksInTransit map[string]bool
 
+//chunks that arrived but failed verification, these are requeued right away
+var chunksRejected map[string]bool
+
 //sets the current bandwith of a file
 func fileBandwidth(FileID string) (Download int, Upload int) {
 
@@ -55,26 +59,44 @@ func fileBandwidth(FileID string) (Download int, Upload int) {
 	return int(fileBandwidthMap[FileID].Download.Avg()), int(fileBandwidthMap[FileID].Upload.Avg())
 }
 
-func downloadChunks(file *models.File, randomChunks []int) {
+func downloadChunks(file *models.File, chunks []int) {
 	log.Println("Starting download for file:", file.FileName, file.FileHash, "size:", file.FileSize)
 
 	fileID := file.FileHash
 
 	//todo: lock seeders
-	for file == nil || !AnySeeders(fileID) {
+	restorePeerHints(fileID)
+	for !AnySeeders(fileID) {
+		//Give up the download slot when the download was paused or removed in the meantime
+		if !isDownloadActive(fileID) {
+			downloadFinished(fileID)
+			return
+		}
 		time.Sleep(time.Second)
+	}
 
-		//TODO: this might not be needed anymore now we have the file seeder tracker.
-		file = getListedFileByHash(fileID)
+	//Order in which chunks are requested, stored per file
+	strategy := file.ChunkStrategy
+	dbFile, err := dbGetFile(fileID)
+	if err == nil {
+		strategy = dbFile.ChunkStrategy
 	}
+	if !IsValidChunkStrategy(strategy) {
+		strategy = getDefaultChunkStrategy()
+	}
+	picker := newChunkPicker(strategy, chunks, chunkAvailability(fileID))
 
-	numChunks := len(randomChunks)
+	//Number of chunks requested and not yet received or requeued
+	chunksRequested := int32(0)
 
-	seederAlternator := 0
-	appendChunkLock := sync.Mutex{}
 	recreateSessionLock := sync.Mutex{}
 	lastRecreateTime := int64(0)
 
+	//Get the chunk hashes so each chunk can be verified on arrival
+	if getChunkHashes(fileID) == nil {
+		fetchChunkHashes(fileID)
+	}
+
 	//Give the seeder a fair start with timers when a download is initiated
 	//Potentionally this seeder was last queried 60 seconds ago for files and otherwise idle but online
 	//todo: Lock seeders
@@ -83,6 +105,8 @@ func downloadChunks(file *models.File, randomChunks []int) {
 	}
 
 	downloadJob := func(terminateFlag *bool) {
+		//Free the download slot for the next queued download
+		defer downloadFinished(fileID)
 
 		//Used to terminate the rescanning of peers
 		terminate := func(flag *bool) {
@@ -90,7 +114,10 @@ func downloadChunks(file *models.File, randomChunks []int) {
 		}
 		defer terminate(terminateFlag)
 
-		for i := 0; i < numChunks; i++ {
+		//Chunks that none of the seeders have at the moment
+		unavailableChunks := []int{}
+
+		for {
 			dbFile, err := dbGetFile(fileID)
 
 			//Check if file is still tracked in surge
@@ -104,15 +131,45 @@ func downloadChunks(file *models.File, randomChunks []int) {
 				return
 			}
 
+			//Get the next chunk, when none are left we wait for chunks in transit as these might be requeued
+			chunkID, hasChunk := picker.Next()
+			if !hasChunk {
+				//Chunks no seeder had get another chance once chunk maps are refreshed
+				if len(unavailableChunks) > 0 {
+					time.Sleep(time.Second)
+					for _, unavailableChunkID := range unavailableChunks {
+						picker.Requeue(unavailableChunkID)
+					}
+					unavailableChunks = []int{}
+					continue
+				}
+
+				if atomic.LoadInt32(&chunksRequested) == 0 {
+					return
+				}
+				time.Sleep(time.Second)
+				continue
+			}
+
+			//Set aside chunks none of our seeders have
+			if AnySeeders(fileID) && !anySeederHasChunk(fileID, chunkID) {
+				unavailableChunks = append(unavailableChunks, chunkID)
+				continue
+			}
+
+			//Hold back the request while the download caps are exceeded
+			waitDownload(dbFile, chunkSize(dbFile, chunkID))
+
 			//Create a async job to download a chunk
 			requestChunkJob := func(chunkID int, downloadSeederAddr string) {
-				requeue := func() {
-					fmt.Println("Chunk ID", chunkID, " failed, and is being listed to be fetched again.")
-					appendChunkLock.Lock()
-					randomChunks = append(randomChunks, chunkID)
-					numChunks++
-					appendChunkLock.Unlock()
+				defer atomic.AddInt32(&chunksRequested, -1)
 
+				requeueChunk := func() {
+					fmt.Println("Chunk ID", chunkID, " failed, and is being listed to be fetched again.")
+					atomic.AddInt64(&metricChunkRequeues, 1)
+					picker.Requeue(chunkID)
+				}
+				releaseWorker := func() {
 					//TODO: Remove this clamp, dont double count timeouted arrivals
 					mutexes.WorkerMapLock.Lock()
 					workerMap[downloadSeederAddr]--
@@ -121,6 +178,10 @@ func downloadChunks(file *models.File, randomChunks []int) {
 					}
 					mutexes.WorkerMapLock.Unlock()
 				}
+				requeue := func() {
+					requeueChunk()
+					releaseWorker()
+				}
 
 				recreateSessionLock.Lock()
 				session, err := sessionmanager.GetSession(downloadSeederAddr)
@@ -136,6 +197,7 @@ func downloadChunks(file *models.File, randomChunks []int) {
 
 				//if download fails return
 				if !successRequest {
+					recordSeederError(downloadSeederAddr)
 					requeue()
 					return
 				}
@@ -145,6 +207,9 @@ func downloadChunks(file *models.File, randomChunks []int) {
 
 				mutexes.ChunkInTransitLock.Lock()
 				chunksInTransit[chunkKey] = true
+				chunksRejected[chunkKey] = false
+				delete(chunksRefused, chunkKey)
+				chunkRequestTimes[chunkKey] = time.Now()
 				mutexes.ChunkInTransitLock.Unlock()
 
 				//Sleep and check if entry still exists in transit map.
@@ -167,23 +232,72 @@ func downloadChunks(file *models.File, randomChunks []int) {
 					//Check if received
 					mutexes.ChunkInTransitLock.Lock()
 					isInTransit := chunksInTransit[chunkKey]
+					isRejected := chunksRejected[chunkKey]
+					refusal, isRefused := chunksRefused[chunkKey]
+					delete(chunksRefused, chunkKey)
 					mutexes.ChunkInTransitLock.Unlock()
 
 					if !isInTransit {
+						//chunk received but corrupt, fetch it again
+						//the seeder worker is already released on arrival
+						if isRejected {
+							recordSeederError(downloadSeederAddr)
+							requeueChunk()
+							return
+						}
+
+						//seeder rejected the request or is busy, fetch it again from any seeder
+						//the seeder worker is already released on the reply
+						if isRefused {
+							if refusal.ID == constants.SurgeChunkBusyID {
+								//Give the seeder time to make room, other seeders are preferred meanwhile
+								log.Println("Seeder", downloadSeederAddr, "busy, requeueing chunk", chunkID)
+								recordSeederBusy(downloadSeederAddr)
+								time.Sleep(time.Second * constants.SeederBusyBackoff)
+							} else if refusal.Reason == constants.ChunkRejectReadError {
+								recordSeederError(downloadSeederAddr)
+							}
+							requeueChunk()
+							return
+						}
+
 						//chunk received! if no longer in transit, continue workers
 						inTransit = false
 						sleepWorker = false
 						break
 					}
 
+					//Cancel the request when the download was paused or removed in the meantime, the chunk is picked up again on restart
+					if !isDownloadActive(fileID) {
+						CancelChunk(session, fileID, int32(chunkID))
+						mutexes.ChunkInTransitLock.Lock()
+						chunksInTransit[chunkKey] = false
+						delete(chunkRequestTimes, chunkKey)
+						mutexes.ChunkInTransitLock.Unlock()
+						releaseWorker()
+						return
+					}
+
 					_, currentSessionExists := sessionmanager.GetExistingSessionWithoutClosing(downloadSeederAddr, constants.WorkerGetSessionTimeout)
 
-					if receiveTimeoutCounter >= constants.WorkerChunkReceiveTimeout && !currentSessionExists {
-						//if timeout is triggered, leave in transit.
+					if receiveTimeoutCounter >= constants.WorkerChunkReceiveTimeout {
+						//The chunk missed its deadline, this counts against the seeder whether or not its session is still alive
 						log.Println(string("\033[36m"), "timeout is triggered, leave in transit.", string("\033[0m"))
+						CancelChunk(session, fileID, int32(chunkID))
+						recordSeederTimeout(downloadSeederAddr)
+						atomic.AddInt64(&metricChunkTimeouts, 1)
 						inTransit = true
 						sleepWorker = false
 
+						//A slow seeder keeps its session, the chunk is fetched again from the best seeder now
+						if currentSessionExists {
+							mutexes.ChunkInTransitLock.Lock()
+							chunksInTransit[chunkKey] = false
+							delete(chunkRequestTimes, chunkKey)
+							mutexes.ChunkInTransitLock.Unlock()
+							break
+						}
+
 						//Try replacing the session with a new one.
 						lockTime := time.Now().Unix()
 
@@ -224,51 +338,37 @@ func downloadChunks(file *models.File, randomChunks []int) {
 				}
 			}
 
+			//spin until the best seeder with the chunk has a worker available
 			downloadSeederAddr := ""
-
-			//spin to seeder with workers available
-			spinForSeeder := true
-			for spinForSeeder {
+			for {
 				for !AnySeeders(fileID) {
 					fmt.Println(string("\033[36m"), "sleeping for seeders.", string("\033[0m"))
 					time.Sleep(time.Second)
+					restorePeerHints(fileID)
 				}
 
-				downloadSeederAddr = GetSeeders(fileID)[seederAlternator]
-
-				//If seeder selected exceeds worker limit skip
-				mutexes.WorkerMapLock.Lock()
-				seedWorkerNum := workerMap[downloadSeederAddr]
-				mutexes.WorkerMapLock.Unlock()
-
-				if seedWorkerNum >= getNumberWorkers() {
-					seederAlternator++
-					if seederAlternator > len(GetSeeders(fileID))-1 {
-						seederAlternator = 0
-
-						//When weve spun a complete seeder cycle we sleep
-						time.Sleep(time.Millisecond)
-					}
-				} else {
-					//If the seeder has room for more workers we accept
-					spinForSeeder = false
-					mutexes.WorkerMapLock.Lock()
-					workerMap[downloadSeederAddr]++
-					mutexes.WorkerMapLock.Unlock()
+				seeder, picked := pickSeeder(fileID, chunkID)
+				if picked {
+					downloadSeederAddr = seeder
+					break
 				}
+				time.Sleep(time.Millisecond)
 			}
 
-			//get chunk id
-			appendChunkLock.Lock()
-			chunkid := randomChunks[i]
-			appendChunkLock.Unlock()
-
-			go requestChunkJob(chunkid, downloadSeederAddr)
+			atomic.AddInt32(&chunksRequested, 1)
+			go requestChunkJob(chunkID, downloadSeederAddr)
 		}
 	}
 
 	terminateFlag := false
 	go downloadJob(&terminateFlag)
+	go refreshSeederChunkMaps(fileID, &terminateFlag)
+}
+
+// returns whether a file is downloading and not paused
+func isDownloadActive(fileID string) bool {
+	dbFile, err := dbGetFile(fileID)
+	return err == nil && dbFile.IsDownloading && !dbFile.IsPaused
 }
 
 func chunksDownloaded(s []byte, num int) int {
@@ -312,6 +412,7 @@ func RequestChunk(Session *sessionmanager.Session, FileID string, ChunkID int32)
 		mutexes.BandwidthAccumulatorMapLock.Lock()
 		uploadBandwidthAccumulator[FileID] += written
 		mutexes.BandwidthAccumulatorMapLock.Unlock()
+		atomic.AddInt64(&metricBytesUploaded, int64(written))
 	}
 
 	return true
@@ -321,16 +422,31 @@ func RequestChunk(Session *sessionmanager.Session, FileID string, ChunkID int32)
 func TransmitChunk(Session *sessionmanager.Session, FileID string, ChunkID int32) {
 	defer RecoverAndLog()
 
+	//The downloader might have canceled while the request was queued
+	addr := Session.Session.RemoteAddr().String()
+	if isTransmitCanceled(addr, FileID, ChunkID) {
+		return
+	}
+	defer removePendingTransmit(addr, FileID, ChunkID)
+
 	//Open file
 
 	mutexes.FileWriteLock.Lock()
 	fileInfo, err := dbGetFile(FileID)
 	if err != nil {
+		mutexes.FileWriteLock.Unlock()
 		log.Println("Error on transmit chunk - file not in db", err.Error())
+		RejectChunk(Session, FileID, ChunkID, constants.ChunkRejectNotSeeded)
+		return
+	}
+
+	//Downloads only serve the chunks they already have
+	if !fileInfo.IsUploading && (fileInfo.ChunkMap == nil || ChunkID < 0 || int(ChunkID) >= fileInfo.NumChunks || !bitmap.Get(fileInfo.ChunkMap, int(ChunkID))) {
+		mutexes.FileWriteLock.Unlock()
+		log.Println("Error on transmit chunk - chunk not available", FileID, ChunkID)
+		RejectChunk(Session, FileID, ChunkID, constants.ChunkRejectNotAvailable)
 		return
 	}
-	fileInfo.ChunksShared++
-	dbInsertFile(*fileInfo)
 	mutexes.FileWriteLock.Unlock()
 
 	_, err = os.Stat(fileInfo.Path)
@@ -338,20 +454,35 @@ func TransmitChunk(Session *sessionmanager.Session, FileID string, ChunkID int32
 	if err != nil {
 		log.Println("Error on transmit chunk - file no longer at path, stopping upload.", err.Error())
 
+		//Read the file again, it may have changed since we released the lock
 		mutexes.FileWriteLock.Lock()
-		fileInfo.IsMissing = true
-		fileInfo.IsDownloading = false
-		fileInfo.IsUploading = false
-		fileInfo.IsAvailable = false
-		dbInsertFile(*fileInfo)
+		missingFile, err := dbGetFile(FileID)
+		if err == nil {
+			missingFile.IsMissing = true
+			missingFile.IsDownloading = false
+			missingFile.IsUploading = false
+			missingFile.IsAvailable = false
+			dbInsertFile(*missingFile)
+		}
 		mutexes.FileWriteLock.Unlock()
 
+		RejectChunk(Session, FileID, ChunkID, constants.ChunkRejectNotSeeded)
+		return
+	}
+
+	//Hold back the chunk while the upload caps are exceeded
+	waitUpload(fileInfo, chunkSize(fileInfo, int(ChunkID)))
+
+	//The downloader might have canceled while we waited
+	if isTransmitCanceled(addr, FileID, ChunkID) {
+		log.Println("Transmit chunk canceled by downloader", FileID, ChunkID)
 		return
 	}
 
 	file, err := os.Open(fileInfo.Path)
 	if err != nil {
 		log.Println("Error on transmit chunk - file read failure", err.Error())
+		RejectChunk(Session, FileID, ChunkID, constants.ChunkRejectReadError)
 		return
 	}
 
@@ -364,6 +495,7 @@ func TransmitChunk(Session *sessionmanager.Session, FileID string, ChunkID int32
 	if err != nil {
 		if err != io.EOF {
 			log.Println("Error on transmit chunk - read chunk failed: ", ChunkID, err.Error())
+			RejectChunk(Session, FileID, ChunkID, constants.ChunkRejectReadError)
 			return
 		}
 	}
@@ -388,11 +520,13 @@ func TransmitChunk(Session *sessionmanager.Session, FileID string, ChunkID int32
 		return
 	}
 	log.Println("Chunk transmitted: ", bytesread, " bytes")
+	addChunkShared(FileID)
 
 	//Write add to upload
 	mutexes.BandwidthAccumulatorMapLock.Lock()
 	uploadBandwidthAccumulator[FileID] += written
 	mutexes.BandwidthAccumulatorMapLock.Unlock()
+	atomic.AddInt64(&metricBytesUploaded, int64(written))
 }
 
 // SessionWrite writes to session
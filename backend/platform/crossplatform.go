@@ -18,13 +18,26 @@ type setVisualMode func(int)
 
 var setVisualModeRef setVisualMode
 
+var headlessAskUser func(context string, payload string)
+
 // SetWailsContext binds the runtime
 func SetWailsContext(ctx *context.Context, setVisualModeFunc setVisualMode) {
 	wailsContext = ctx
 	setVisualModeRef = setVisualModeFunc
 }
 
+// SetHeadlessHandler routes user prompts to a handler when no wails frontend is bound
+func SetHeadlessHandler(askUserFunc func(context string, payload string)) {
+	headlessAskUser = askUserFunc
+}
+
 //AskUser emit ask user event
 func AskUser(context string, payload string) {
+	if wailsContext == nil {
+		if headlessAskUser != nil {
+			headlessAskUser(context, payload)
+		}
+		return
+	}
 	runtime.EventsEmit(*wailsContext, "userEvent", context, payload)
 }
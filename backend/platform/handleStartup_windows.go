@@ -10,6 +10,7 @@ import (
 
 	"log"
 
+	"github.com/rule110-io/surge/backend/magnet"
 	"github.com/rule110-io/surge/mailslot"
 	"github.com/sqweek/dialog"
 )
@@ -31,7 +32,7 @@ func ProcessStartupArgs(args []string, frontendReady *bool) bool {
 	magnetString := ""
 
 	//Check if param is magnet
-	magnetFound := strings.Contains(lastArg, "surge://|file|")
+	magnetFound := magnet.Contains(lastArg)
 	if magnetFound {
 		magnetString = lastArg
 	}
@@ -0,0 +1,89 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains a token bucket used to cap bandwidth
+	Tokens are bytes, they refill at the configured rate up to one second worth of burst
+*/
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+//Bucket is a token bucket, a rate of 0 means unlimited
+type Bucket struct {
+	rate       int64 //bytes per second
+	tokens     float64
+	lastRefill time.Time
+	lock       sync.Mutex
+}
+
+//NewBucket creates a bucket filling at rate bytes per second, 0 means unlimited, it starts with a full burst
+func NewBucket(rate int64) *Bucket {
+	if rate < 0 {
+		rate = 0
+	}
+	return &Bucket{
+		rate:       rate,
+		tokens:     float64(rate),
+		lastRefill: time.Now(),
+	}
+}
+
+//SetRate changes the rate of the bucket, it takes effect for the next Wait
+//tokens are only clamped to the new burst, changing the rate does not refill the bucket or clear its debt
+func (b *Bucket) SetRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if rate < 0 {
+		rate = 0
+	}
+	b.refill(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+//Rate returns the rate of the bucket in bytes per second
+func (b *Bucket) Rate() int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.rate
+}
+
+//Wait blocks until n bytes may pass, requests larger than the burst go into debt so chunks bigger than the rate still pass
+func (b *Bucket) Wait(n int) {
+	b.lock.Lock()
+	if b.rate == 0 {
+		b.lock.Unlock()
+		return
+	}
+
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	wait := time.Duration(0)
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+	}
+	b.lock.Unlock()
+
+	time.Sleep(wait)
+}
+
+// adds the tokens filled since the last refill up to one second worth, call with lock held
+func (b *Bucket) refill(now time.Time) {
+	if b.rate > 0 {
+		b.tokens += now.Sub(b.lastRefill).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.lastRefill = now
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBucketStartsFull(t *testing.T) {
+	tests := []struct {
+		rate       int64
+		wantRate   int64
+		wantTokens float64
+	}{
+		{rate: 1000, wantRate: 1000, wantTokens: 1000},
+		{rate: 0, wantRate: 0, wantTokens: 0},
+		{rate: -5, wantRate: 0, wantTokens: 0},
+	}
+
+	for _, test := range tests {
+		bucket := NewBucket(test.rate)
+		if bucket.Rate() != test.wantRate || bucket.tokens != test.wantTokens {
+			t.Fatalf("NewBucket(%d) has rate %d and %f tokens, want %d and %f", test.rate, bucket.Rate(), bucket.tokens, test.wantRate, test.wantTokens)
+		}
+	}
+}
+
+func TestSetRateOnlyClampsTokens(t *testing.T) {
+	tests := []struct {
+		name       string
+		rate       int64
+		tokens     float64
+		newRate    int64
+		wantTokens float64
+	}{
+		{name: "lower rate clamps saved tokens", rate: 1000, tokens: 800, newRate: 500, wantTokens: 500},
+		{name: "higher rate does not refill", rate: 1000, tokens: 100, newRate: 5000, wantTokens: 100},
+		{name: "debt is kept", rate: 1000, tokens: -3000, newRate: 2000, wantTokens: -3000},
+		{name: "same rate does not refill", rate: 1000, tokens: 0, newRate: 1000, wantTokens: 0},
+		{name: "unlimited to limited starts empty", rate: 0, tokens: 0, newRate: 1000, wantTokens: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := NewBucket(test.rate)
+			bucket.tokens = test.tokens
+			bucket.lastRefill = time.Now()
+
+			//Less than a token refills until SetRate
+			bucket.SetRate(test.newRate)
+			if bucket.tokens < test.wantTokens || bucket.tokens > test.wantTokens+1 {
+				t.Fatalf("got %f tokens, want %f", bucket.tokens, test.wantTokens)
+			}
+			if bucket.Rate() != test.newRate {
+				t.Fatalf("got rate %d, want %d", bucket.Rate(), test.newRate)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     int64
+		requests []int
+		wantWait time.Duration
+	}{
+		{name: "unlimited", rate: 0, requests: []int{1 << 30}, wantWait: 0},
+		{name: "within burst", rate: 10000, requests: []int{5000, 5000}, wantWait: 0},
+		{name: "beyond burst", rate: 10000, requests: []int{10000, 1000}, wantWait: 100 * time.Millisecond},
+		{name: "larger than the rate goes into debt", rate: 10000, requests: []int{12000}, wantWait: 200 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bucket := NewBucket(test.rate)
+			start := time.Now()
+			for _, n := range test.requests {
+				bucket.Wait(n)
+			}
+			waited := time.Since(start)
+			if waited < test.wantWait || waited > test.wantWait+50*time.Millisecond {
+				t.Fatalf("waited %s, want %s", waited, test.wantWait)
+			}
+		})
+	}
+}
+
+func TestToggledRateDoesNotBypassCap(t *testing.T) {
+	bucket := NewBucket(10000)
+	bucket.Wait(10000)
+
+	//Changing the limit back and forth must not grant a new burst
+	bucket.SetRate(20000)
+	bucket.SetRate(10000)
+
+	start := time.Now()
+	bucket.Wait(1000)
+	if waited := time.Since(start); waited < 90*time.Millisecond {
+		t.Fatalf("waited %s after toggling the rate, want about 100ms", waited)
+	}
+}
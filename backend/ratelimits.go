@@ -0,0 +1,117 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the bandwidth caps
+	Uploads and downloads pass a per file and a global token bucket, caps are in bytes per second and 0 means unlimited.
+*/
+
+package surge
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/models"
+	"github.com/rule110-io/surge/backend/ratelimit"
+)
+
+var globalUploadBucket = ratelimit.NewBucket(0)
+var globalDownloadBucket = ratelimit.NewBucket(0)
+
+//Per file buckets by file hash
+var fileUploadBuckets = map[string]*ratelimit.Bucket{}
+var fileDownloadBuckets = map[string]*ratelimit.Bucket{}
+var rateLimitLock = sync.Mutex{}
+
+// reads a cap in bytes per second from settings
+func readRateLimitSetting(key string) int64 {
+	value, err := DbReadSetting(key)
+	if err != nil || len(value) == 0 {
+		return 0
+	}
+	rate, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || rate < 0 {
+		return 0
+	}
+	return rate
+}
+
+//GetGlobalRateLimits returns the global download and upload caps in bytes per second
+func GetGlobalRateLimits() (Download int64, Upload int64) {
+	return readRateLimitSetting("downloadLimit"), readRateLimitSetting("uploadLimit")
+}
+
+// applies the global caps from settings to the global buckets
+func applyRateLimitSettings() {
+	download, upload := GetGlobalRateLimits()
+	globalDownloadBucket.SetRate(download)
+	globalUploadBucket.SetRate(upload)
+}
+
+//SetGlobalRateLimits stores the global caps and applies them right away
+func SetGlobalRateLimits(Download int64, Upload int64) bool {
+	if Download < 0 || Upload < 0 {
+		pushError("Error on set rate limit", "limits can not be negative")
+		return false
+	}
+
+	err := DbWriteSetting("downloadLimit", strconv.FormatInt(Download, 10))
+	if err == nil {
+		err = DbWriteSetting("uploadLimit", strconv.FormatInt(Upload, 10))
+	}
+	if err != nil {
+		pushError("Error on set rate limit", err.Error())
+		return false
+	}
+
+	applyRateLimitSettings()
+	return true
+}
+
+// returns the bucket of a file, its rate is updated when the cap of the file changed
+func getFileBucket(buckets map[string]*ratelimit.Bucket, fileHash string, rate int64) *ratelimit.Bucket {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+
+	bucket, exists := buckets[fileHash]
+	if !exists {
+		bucket = ratelimit.NewBucket(rate)
+		buckets[fileHash] = bucket
+	} else if bucket.Rate() != rate {
+		bucket.SetRate(rate)
+	}
+	return bucket
+}
+
+// removes the buckets of a file
+func removeFileBuckets(fileHash string) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+
+	delete(fileUploadBuckets, fileHash)
+	delete(fileDownloadBuckets, fileHash)
+}
+
+// blocks until size bytes of a file may be uploaded
+func waitUpload(file *models.File, size int) {
+	getFileBucket(fileUploadBuckets, file.FileHash, file.UploadLimit).Wait(size)
+	globalUploadBucket.Wait(size)
+}
+
+// blocks until size bytes of a file may be downloaded
+func waitDownload(file *models.File, size int) {
+	getFileBucket(fileDownloadBuckets, file.FileHash, file.DownloadLimit).Wait(size)
+	globalDownloadBucket.Wait(size)
+}
+
+// returns the size of a chunk, only the last chunk of a file is smaller than the chunk size
+func chunkSize(file *models.File, chunkID int) int {
+	remaining := file.FileSize - int64(chunkID)*constants.ChunkSize
+	if remaining < constants.ChunkSize {
+		return int(remaining)
+	}
+	return constants.ChunkSize
+}
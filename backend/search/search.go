@@ -0,0 +1,174 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the matching of search queries
+	Queries and names are split into lower case words, every word of the query has to match a word of the name,
+	exactly, as a prefix, as part of the name or with a few typos. How well the words match is the relevance.
+	Words of at least MinHashTokenLength characters also match the hash.
+*/
+
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+//MinHashTokenLength is the length from which query words are matched against hashes, shorter words would match most hashes
+const MinHashTokenLength = 4
+
+//Relevance of the ways a word can match
+const (
+	scoreExact     = 1.0
+	scorePrefix    = 0.8
+	scoreSubstring = 0.6
+	scoreFuzzy     = 0.5
+	scorePhrase    = 0.2 //bonus when the words of the query appear in the name in a row
+)
+
+//Query is a parsed search query
+type Query struct {
+	phrase string
+	tokens []string
+}
+
+//Parse parses a search query, an empty query matches everything
+func Parse(query string) Query {
+	tokens := Tokenize(query)
+	return Query{
+		phrase: strings.Join(tokens, " "),
+		tokens: tokens,
+	}
+}
+
+//IsEmpty returns whether the query has no words
+func (q Query) IsEmpty() bool {
+	return len(q.tokens) == 0
+}
+
+//Match returns the relevance of a listing to the query and whether every word of the query matched
+func (q Query) Match(name string, hash string) (float64, bool) {
+	if q.IsEmpty() {
+		return 0, true
+	}
+
+	lowerName := strings.ToLower(name)
+	lowerHash := strings.ToLower(hash)
+	nameTokens := Tokenize(name)
+
+	total := 0.0
+	for _, token := range q.tokens {
+		score := matchToken(token, lowerName, nameTokens)
+		if len(token) >= MinHashTokenLength && strings.Contains(lowerHash, token) {
+			score = scoreExact
+		}
+		if score == 0 {
+			return 0, false
+		}
+		total += score
+	}
+
+	relevance := total / float64(len(q.tokens))
+	if len(q.tokens) > 1 && strings.Contains(strings.Join(nameTokens, " "), q.phrase) {
+		relevance += scorePhrase
+	}
+	return relevance, true
+}
+
+//Tokenize splits a text into lower case words at every character that is not a letter or digit
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// returns the best relevance of a query word against the words of a name, 0 when it does not match
+func matchToken(token string, lowerName string, nameTokens []string) float64 {
+	best := 0.0
+	for _, nameToken := range nameTokens {
+		switch {
+		case nameToken == token:
+			return scoreExact
+		case strings.HasPrefix(nameToken, token):
+			best = maxFloat(best, scorePrefix)
+		default:
+			allowed := allowedTypos(token)
+			if allowed == 0 {
+				continue
+			}
+			//Typos are also forgiven in the start of a longer word, so partly typed words match
+			tokenLength := len([]rune(token))
+			typos := distance(token, nameToken)
+			if nameRunes := []rune(nameToken); len(nameRunes) > tokenLength {
+				typos = minInt(typos, distance(token, string(nameRunes[:tokenLength])))
+			}
+			if typos <= allowed {
+				best = maxFloat(best, scoreFuzzy*(1-float64(typos)/float64(tokenLength+1)))
+			}
+		}
+	}
+
+	if best < scoreSubstring && strings.Contains(lowerName, token) {
+		best = scoreSubstring
+	}
+	return best
+}
+
+// returns the number of typos forgiven in a word, none in short words as they would match too much
+func allowedTypos(token string) int {
+	length := len([]rune(token))
+	switch {
+	case length <= 3:
+		return 0
+	case length <= 6:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// returns the number of insertions, deletions, substitutions and swaps of neighbours that turn a into b
+func distance(a string, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	//Three rows of the matrix are enough, swaps look two rows back
+	previous2 := make([]int, len(rb)+1)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				current[j] = minInt(current[j], previous2[j-2]+1)
+			}
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return previous[len(rb)]
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
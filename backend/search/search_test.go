@@ -0,0 +1,101 @@
+package search
+
+import "testing"
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{text: "The_Two.Towers-Trailer (2002).AVI", want: []string{"the", "two", "towers", "trailer", "2002", "avi"}},
+		{text: "  Ünïcode   Wörds ", want: []string{"ünïcode", "wörds"}},
+		{text: "", want: []string{}},
+		{text: "--__..", want: []string{}},
+	}
+
+	for _, test := range tests {
+		got := Tokenize(test.text)
+		if len(got) != len(test.want) {
+			t.Fatalf("Tokenize(%q) = %v, want %v", test.text, got, test.want)
+		}
+		for i := range test.want {
+			if got[i] != test.want[i] {
+				t.Fatalf("Tokenize(%q) = %v, want %v", test.text, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{a: "towers", b: "towers", want: 0},
+		{a: "towrs", b: "towers", want: 1},
+		{a: "towerss", b: "towers", want: 1},
+		{a: "tawers", b: "towers", want: 1},
+		{a: "otwers", b: "towers", want: 1},
+		{a: "", b: "abc", want: 3},
+		{a: "kitten", b: "sitting", want: 3},
+	}
+
+	for _, test := range tests {
+		if got := distance(test.a, test.b); got != test.want {
+			t.Fatalf("distance(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	const name = "The_Two_Towers-Trailer.avi"
+	const hash = "965c013e991ee246d63d45ea71954c4d"
+
+	tests := []struct {
+		query     string
+		matches   bool
+		relevance float64
+	}{
+		{query: "", matches: true, relevance: 0},
+		{query: "towers", matches: true, relevance: scoreExact},
+		{query: "TOWERS", matches: true, relevance: scoreExact},
+		{query: "tow", matches: true, relevance: scorePrefix},
+		{query: "ailer", matches: true, relevance: scoreSubstring},
+		{query: "towrs", matches: true, relevance: scoreFuzzy * (1 - 1.0/6)},
+		{query: "trialer", matches: true, relevance: scoreFuzzy * (1 - 1.0/8)},
+		{query: "two towers", matches: true, relevance: scoreExact + scorePhrase},
+		{query: "towers two", matches: true, relevance: scoreExact},
+		{query: "965c", matches: true, relevance: scoreExact},
+		{query: "965", matches: false},
+		{query: "twx", matches: false},
+		{query: "towers king", matches: false},
+		{query: "xyzzyx", matches: false},
+	}
+
+	for _, test := range tests {
+		relevance, matches := Parse(test.query).Match(name, hash)
+		if matches != test.matches {
+			t.Fatalf("query %q matches %t, want %t", test.query, matches, test.matches)
+		}
+		if matches && !almostEqual(relevance, test.relevance) {
+			t.Fatalf("query %q has relevance %f, want %f", test.query, relevance, test.relevance)
+		}
+	}
+}
+
+func TestBetterMatchesRankHigher(t *testing.T) {
+	query := Parse("towers")
+	exact, _ := query.Match("towers.avi", "")
+	prefix, _ := query.Match("towersandmore.avi", "")
+	typo, _ := query.Match("towrs.avi", "")
+
+	if !(exact > prefix && prefix > typo) {
+		t.Fatalf("relevance exact %f, prefix %f, typo %f, want decreasing", exact, prefix, typo)
+	}
+}
+
+func almostEqual(a float64, b float64) bool {
+	difference := a - b
+	return difference < 1e-9 && difference > -1e-9
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the seeder statistics
+	Every chunk we download is measured per seeder, chunks are requested from the seeders with the best
+	throughput and success rate. Seeders that time out or fail are backed off for a while, longer on every failure in a row.
+	The number of chunks requested from a seeder at once is its window, it grows by one chunk per window of chunks
+	received as long as every growth improves the throughput, steps back when it does not and halves on failures.
+	The workers setting is the upper bound of every window.
+*/
+
+package surge
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/mutexes"
+)
+
+//Measured performance of a seeder
+type seederStats struct {
+	ChunksReceived      int
+	BytesReceived       int64
+	RoundTrip           time.Duration //smoothed time between request and arrival of a chunk
+	Throughput          float64       //smoothed bytes per second
+	Timeouts            int
+	Errors              int
+	Window              float64         //chunks we request at once
+	windowGoodputs      map[int]float64 //bytes per second over all chunks in flight, by window size
+	windowBytes         int64           //bytes received since the window last changed size
+	windowTime          float64         //round trips in seconds summed since the window last changed size
+	windowInFlight      int             //chunks in flight summed since the window last changed size
+	windowChunks        int             //chunks received since the window last changed size
+	consecutiveFailures int
+	backoffUntil        time.Time
+}
+
+//SeederStats describes the measured performance of a seeder
+type SeederStats struct {
+	ChunksReceived int
+	BytesReceived  int64
+	RoundTripMs    int64
+	Throughput     int64 //bytes per second
+	Timeouts       int
+	Errors         int
+	BackedOff      bool
+	Window         int
+}
+
+//Stats by seeder address
+var seederStatsMap = map[string]*seederStats{}
+var seederStatsLock = sync.Mutex{}
+
+//time each chunk in transit was requested, keyed like chunksInTransit
+var chunkRequestTimes map[string]time.Time
+
+// returns the stats of a seeder, call with seederStatsLock held
+func getSeederStats(addr string) *seederStats {
+	stats, exists := seederStatsMap[addr]
+	if !exists {
+		stats = &seederStats{
+			Window:         constants.SeederWindowInitial,
+			windowGoodputs: map[int]float64{},
+		}
+		seederStatsMap[addr] = stats
+	}
+	return stats
+}
+
+// records a chunk that arrived intact, inFlight is the number of chunks that were requested from the seeder at the time
+func recordSeederChunk(addr string, size int, roundTrip time.Duration, inFlight int) {
+	maxWindow := getNumberWorkers()
+
+	seederStatsLock.Lock()
+	defer seederStatsLock.Unlock()
+
+	stats := getSeederStats(addr)
+	throughput := float64(size) / math.Max(roundTrip.Seconds(), 0.001)
+	if stats.ChunksReceived == 0 {
+		stats.RoundTrip = roundTrip
+		stats.Throughput = throughput
+	} else {
+		alpha := constants.SeederStatsSmoothing
+		stats.RoundTrip = time.Duration(alpha*float64(roundTrip) + (1-alpha)*float64(stats.RoundTrip))
+		stats.Throughput = alpha*throughput + (1-alpha)*stats.Throughput
+	}
+	stats.ChunksReceived++
+	stats.BytesReceived += int64(size)
+	stats.consecutiveFailures = 0
+	stats.backoffUntil = time.Time{}
+
+	stats.windowBytes += int64(size)
+	stats.windowTime += math.Max(roundTrip.Seconds(), 0.001)
+	stats.windowInFlight += clamp(inFlight, 1, maxWindow)
+	stats.windowChunks++
+	adjustSeederWindow(stats, maxWindow)
+}
+
+// grows the window by one once a full window of chunks was received, a growth that did not improve the goodput is undone, call with seederStatsLock held
+func adjustSeederWindow(stats *seederStats, maxWindow int) {
+	size := int(stats.Window)
+	if stats.windowChunks < size {
+		return
+	}
+
+	//Goodput at the current size is the throughput of a chunk times the chunks in flight
+	stats.windowGoodputs[size] = float64(stats.windowBytes) / stats.windowTime * float64(stats.windowInFlight) / float64(stats.windowChunks)
+	resetSeederWindowPeriod(stats)
+
+	smaller, measured := stats.windowGoodputs[size-1]
+	if size > 1 && measured && stats.windowGoodputs[size] < smaller*constants.SeederWindowGain {
+		stats.Window = float64(size - 1)
+	} else {
+		stats.Window = float64(clamp(size+1, 1, maxWindow))
+	}
+}
+
+// starts measuring the goodput of the window anew, call with seederStatsLock held
+func resetSeederWindowPeriod(stats *seederStats) {
+	stats.windowBytes = 0
+	stats.windowTime = 0
+	stats.windowInFlight = 0
+	stats.windowChunks = 0
+}
+
+// records a chunk request that timed out
+func recordSeederTimeout(addr string) {
+	seederStatsLock.Lock()
+	defer seederStatsLock.Unlock()
+
+	stats := getSeederStats(addr)
+	stats.Timeouts++
+	backOffSeeder(stats)
+}
+
+// records a chunk request that failed or a chunk that arrived corrupt
+func recordSeederError(addr string) {
+	seederStatsLock.Lock()
+	defer seederStatsLock.Unlock()
+
+	stats := getSeederStats(addr)
+	stats.Errors++
+	backOffSeeder(stats)
+}
+
+// records a busy reply, the seeder is skipped for a while without counting it as a failure
+func recordSeederBusy(addr string) {
+	seederStatsLock.Lock()
+	defer seederStatsLock.Unlock()
+
+	stats := getSeederStats(addr)
+	busyUntil := time.Now().Add(time.Second * constants.SeederBusyBackoff)
+	if busyUntil.After(stats.backoffUntil) {
+		stats.backoffUntil = busyUntil
+	}
+}
+
+// halves the window and doubles the back off on every failure in a row, call with seederStatsLock held
+func backOffSeeder(stats *seederStats) {
+	stats.Window = math.Max(float64(int(stats.Window)/2), 1)
+	resetSeederWindowPeriod(stats)
+	stats.consecutiveFailures++
+	backoff := time.Second * constants.SeederBackoffMax
+	if stats.consecutiveFailures < 8 {
+		backoff = time.Duration(math.Min(float64(backoff), float64(time.Second*constants.SeederBackoffBase<<(stats.consecutiveFailures-1))))
+	}
+	stats.backoffUntil = time.Now().Add(backoff)
+}
+
+// returns how much we prefer a seeder, seeders we have not measured yet score as the best seeder so they get tried, call with seederStatsLock held
+func seederScore(addr string) float64 {
+	stats, exists := seederStatsMap[addr]
+	if !exists || stats.ChunksReceived == 0 {
+		best := 1.0
+		for _, other := range seederStatsMap {
+			best = math.Max(best, other.Throughput)
+		}
+		return best
+	}
+
+	successRate := float64(stats.ChunksReceived) / float64(stats.ChunksReceived+stats.Timeouts+stats.Errors)
+	return stats.Throughput * successRate
+}
+
+// returns the number of chunks we request from a seeder at once, call with seederStatsLock held
+func seederWindow(addr string, maxWindow int) int {
+	window := constants.SeederWindowInitial
+	if stats, exists := seederStatsMap[addr]; exists {
+		window = int(stats.Window)
+	}
+	return clamp(window, 1, maxWindow)
+}
+
+// returns whether a seeder is backed off, call with seederStatsLock held
+func isSeederBackedOff(addr string) bool {
+	stats, exists := seederStatsMap[addr]
+	return exists && time.Now().Before(stats.backoffUntil)
+}
+
+// picks the seeder to request a chunk from and claims one of its workers, false when no seeder with the chunk has room in its window
+// backed off seeders are only used when no other seeder has the chunk
+func pickSeeder(fileID string, chunkID int) (string, bool) {
+	candidates := []string{}
+	fallbacks := []string{}
+	maxWindow := getNumberWorkers()
+
+	seederStatsLock.Lock()
+	for _, seeder := range GetSeeders(fileID) {
+		if !SeederHasChunk(fileID, seeder, chunkID) {
+			continue
+		}
+		if isSeederBackedOff(seeder) {
+			fallbacks = append(fallbacks, seeder)
+		} else {
+			candidates = append(candidates, seeder)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = fallbacks
+	}
+	scores := map[string]float64{}
+	windows := map[string]int{}
+	for _, seeder := range candidates {
+		scores[seeder] = seederScore(seeder)
+		windows[seeder] = seederWindow(seeder, maxWindow)
+	}
+	seederStatsLock.Unlock()
+
+	mutexes.WorkerMapLock.Lock()
+	defer mutexes.WorkerMapLock.Unlock()
+
+	//Spread the chunks over seeders by their score and the workers they have busy
+	best := ""
+	bestScore := -1.0
+	for _, seeder := range candidates {
+		workers := workerMap[seeder]
+		if workers >= windows[seeder] {
+			continue
+		}
+		score := scores[seeder] / float64(1+workers)
+		if score > bestScore {
+			best = seeder
+			bestScore = score
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+
+	workerMap[best]++
+	return best, true
+}
+
+//GetSeederStats returns the measured performance of a seeder
+func GetSeederStats(addr string) SeederStats {
+	maxWindow := getNumberWorkers()
+
+	seederStatsLock.Lock()
+	defer seederStatsLock.Unlock()
+
+	stats, exists := seederStatsMap[addr]
+	if !exists {
+		return SeederStats{
+			Window: seederWindow(addr, maxWindow),
+		}
+	}
+	return SeederStats{
+		ChunksReceived: stats.ChunksReceived,
+		BytesReceived:  stats.BytesReceived,
+		RoundTripMs:    stats.RoundTrip.Milliseconds(),
+		Throughput:     int64(stats.Throughput),
+		Timeouts:       stats.Timeouts,
+		Errors:         stats.Errors,
+		BackedOff:      isSeederBackedOff(addr),
+		Window:         seederWindow(addr, maxWindow),
+	}
+}
@@ -0,0 +1,56 @@
+package sessionmanager
+
+import (
+	"net"
+
+	nkn "github.com/nknorg/nkn-sdk-go"
+	"github.com/rule110-io/surge/backend/constants"
+)
+
+// NKNTransport carries sessions over the nkn network using a multiclient
+type NKNTransport struct {
+	client *nkn.MultiClient
+}
+
+//NewNKNTransport creates a transport on top of a connected nkn multiclient
+func NewNKNTransport(client *nkn.MultiClient) *NKNTransport {
+	return &NKNTransport{
+		client: client,
+	}
+}
+
+//Dial opens a nkn session with the given address
+func (t *NKNTransport) Dial(address string) (net.Conn, error) {
+	sessionConfig := nkn.GetDefaultSessionConfig()
+	sessionConfig.MTU = 16384
+	//sessionConfig.CheckTimeoutInterval = 1
+	//sessionConfig.InitialRetransmissionTimeout = 1
+	//sessionConfig.MaxRetransmissionTimeout = 1
+
+	dialConfig := &nkn.DialConfig{
+		SessionConfig: sessionConfig,
+		DialTimeout:   constants.NknClientDialTimeout,
+	}
+
+	return t.client.DialWithConfig(address, dialConfig)
+}
+
+//Accept accepts an incoming nkn session
+func (t *NKNTransport) Accept() (net.Conn, error) {
+	return t.client.Accept()
+}
+
+//Handshake returns the session as is, nkn authenticates the remote address
+func (t *NKNTransport) Handshake(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+//Addr returns the nkn address of the multiclient
+func (t *NKNTransport) Addr() string {
+	return t.client.Addr().String()
+}
+
+//IsClosed returns whether the multiclient is closed
+func (t *NKNTransport) IsClosed() bool {
+	return t.client.IsClosed()
+}
@@ -10,11 +10,9 @@ import (
 	"time"
 
 	"github.com/rule110-io/surge/backend/constants"
-
-	nkn "github.com/nknorg/nkn-sdk-go"
 )
 
-var client *nkn.MultiClient
+var transport Transport
 var listenFunc func(*Session)
 var sessionManagerLock = sync.Mutex{}
 
@@ -29,6 +27,7 @@ type Session struct {
 	Session          net.Conn
 	Reader           *bufio.Reader
 	LastActivityUnix int64
+	OpenedUnix       int64
 }
 
 //A map to hold nkn sessions
@@ -37,16 +36,29 @@ var sessionLockMap map[string]*sync.Mutex
 var sessionLockMapLock sync.Mutex
 
 //Initialize initializes the session manager
-func Initialize(nknClient *nkn.MultiClient, connectFunc func(session *Session, isDialIn bool), disconnectFunc func(addr string)) {
+func Initialize(sessionTransport Transport, connectFunc func(session *Session, isDialIn bool), disconnectFunc func(addr string)) {
 	sessionMap = make(map[string]*Session)
 	sessionLockMap = make(map[string]*sync.Mutex)
 	sessionLockMapLock = sync.Mutex{}
 	//fileMap = make(map[string]*os.File)
-	client = nknClient
+	transport = sessionTransport
 	onConnect = connectFunc
 	onDisconnect = disconnectFunc
 }
 
+//GetLocalAddress returns the address remote peers can dial our sessions on
+func GetLocalAddress() string {
+	return transport.Addr()
+}
+
+//SetPeerAddress sets the address a peer announced to open sessions with it on, when the transport does not dial peers on their nkn address
+func SetPeerAddress(peer string, address string) {
+	addressBook, ok := transport.(peerAddressBook)
+	if ok {
+		addressBook.SetPeerAddress(peer, address)
+	}
+}
+
 //GetSessionLength .
 func GetSessionLength() int {
 	return len(sessionMap)
@@ -156,8 +168,15 @@ func CloseSession(address string) {
 	closeSession(address)
 }
 
-//AcceptSession accepts a incoming session connection
+//AcceptSession accepts a incoming session connection once the transport identified the peer, keyed by the address the peer is dialed on
 func AcceptSession(acceptedConnection net.Conn) *Session {
+	peerConnection, err := transport.Handshake(acceptedConnection)
+	if err != nil {
+		log.Println("Session handshake failed with", acceptedConnection.RemoteAddr(), err)
+		acceptedConnection.Close()
+		return nil
+	}
+	acceptedConnection = peerConnection
 	addr := acceptedConnection.RemoteAddr().String()
 
 	listenReader := bufio.NewReader(acceptedConnection)
@@ -165,11 +184,14 @@ func AcceptSession(acceptedConnection net.Conn) *Session {
 		Reader:           listenReader,
 		Session:          acceptedConnection,
 		LastActivityUnix: time.Now().Unix(),
+		OpenedUnix:       time.Now().Unix(),
 	}
 
 	//Give it a 10 sec headstart, old session workers take up to 10 sec to timeout, then to fetch the new session this would then already be timedout.
 	session.LastActivityUnix = time.Now().Unix() + constants.WorkerGetSessionTimeout
+	sessionLockMapLock.Lock()
 	sessionMap[addr] = session
+	sessionLockMapLock.Unlock()
 
 	go onConnect(session, true)
 
@@ -188,18 +210,7 @@ func UpdateActivity(Address string) {
 }
 
 func createSession(Address string) (*Session, error) {
-	sessionConfig := nkn.GetDefaultSessionConfig()
-	sessionConfig.MTU = 16384
-	//sessionConfig.CheckTimeoutInterval = 1
-	//sessionConfig.InitialRetransmissionTimeout = 1
-	//sessionConfig.MaxRetransmissionTimeout = 1
-
-	dialConfig := &nkn.DialConfig{
-		SessionConfig: sessionConfig,
-		DialTimeout:   constants.NknClientDialTimeout,
-	}
-
-	nknSession, err := client.DialWithConfig(Address, dialConfig)
+	dialedSession, err := transport.Dial(Address)
 	if err != nil {
 		log.Println("Failed to create a session with ", Address, err)
 		fmt.Println(string("\033[31m"), "Failed to create a session with ", Address, err, string("\033[0m"))
@@ -213,13 +224,14 @@ func createSession(Address string) (*Session, error) {
 
 		return nil, err
 	}
-	reader := bufio.NewReader(nknSession)
+	reader := bufio.NewReader(dialedSession)
 	log.Println("Session created for: ", Address)
 
 	session := &Session{
 		Reader:           reader,
-		Session:          nknSession,
+		Session:          dialedSession,
 		LastActivityUnix: time.Now().Unix(),
+		OpenedUnix:       time.Now().Unix(),
 	}
 
 	go onConnect(session, false)
@@ -0,0 +1,275 @@
+package sessionmanager
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	nkn "github.com/nknorg/nkn-sdk-go"
+	"github.com/rule110-io/surge/backend/constants"
+)
+
+//Size of the challenges exchanged in the tcp handshake
+const tcpNonceSize = 32
+
+// TCPTransport carries sessions over plain tcp, used to run several surge nodes on one machine without nkn
+//peers are identified by their nkn address, the handshake proves a connection belongs to it with the account key
+type TCPTransport struct {
+	listener   net.Listener
+	identity   string
+	privateKey ed25519.PrivateKey
+	closed     bool
+	closeLock  sync.Mutex
+
+	//Listen addresses of peers by nkn address
+	peerAddrs     map[string]string
+	peerAddrsLock sync.Mutex
+}
+
+// tcpPeerAddr is the nkn address of a peer the handshake confirmed
+type tcpPeerAddr string
+
+func (a tcpPeerAddr) Network() string { return "tcp" }
+func (a tcpPeerAddr) String() string  { return string(a) }
+
+// tcpConn overrides the remote address of a connection with the nkn address of the peer
+type tcpConn struct {
+	net.Conn
+	remoteAddr tcpPeerAddr
+}
+
+func (c *tcpConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+//NewTCPTransport starts listening for sessions on the given address (eg. 127.0.0.1:7420), peers are authenticated with the account of the client
+func NewTCPTransport(listenAddr string, client *nkn.MultiClient) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TCPTransport{
+		listener:   listener,
+		identity:   client.Addr().String(),
+		privateKey: ed25519.NewKeyFromSeed(client.Account().Seed()),
+		peerAddrs:  make(map[string]string),
+	}, nil
+}
+
+//SetPeerAddress sets the listen address a peer announced, dialing the peer fails the handshake unless the peer proves it owns the nkn address
+func (t *TCPTransport) SetPeerAddress(peer string, address string) {
+	t.peerAddrsLock.Lock()
+	defer t.peerAddrsLock.Unlock()
+
+	t.peerAddrs[peer] = address
+}
+
+func (t *TCPTransport) getPeerAddress(peer string) (string, bool) {
+	t.peerAddrsLock.Lock()
+	defer t.peerAddrsLock.Unlock()
+
+	address, exists := t.peerAddrs[peer]
+	return address, exists
+}
+
+//Dial connects to the listen address of the peer with the given nkn address and checks the peer owns it
+func (t *TCPTransport) Dial(address string) (net.Conn, error) {
+	peerAddr, exists := t.getPeerAddress(address)
+	if !exists {
+		return nil, errors.New("no tcp address known for " + address)
+	}
+
+	conn, err := net.DialTimeout("tcp", peerAddr, constants.NknClientDialTimeout*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(constants.NknClientDialTimeout * time.Millisecond))
+
+	err = t.dialHandshake(conn, address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &tcpConn{
+		Conn:       conn,
+		remoteAddr: tcpPeerAddr(address),
+	}, nil
+}
+
+//Accept accepts an incoming tcp connection, the peer is identified by Handshake
+func (t *TCPTransport) Accept() (net.Conn, error) {
+	return t.listener.Accept()
+}
+
+//Handshake checks which peer dialed an accepted connection, the connection reports the nkn address of the peer as its remote address
+func (t *TCPTransport) Handshake(conn net.Conn) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(constants.NknClientDialTimeout * time.Millisecond))
+
+	peer, err := t.acceptHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return &tcpConn{
+		Conn:       conn,
+		remoteAddr: tcpPeerAddr(peer),
+	}, nil
+}
+
+//Addr returns the address we are listening on, loopback when listening on all interfaces as that address can not be dialed
+func (t *TCPTransport) Addr() string {
+	listenAddr := t.listener.Addr().(*net.TCPAddr)
+	if listenAddr.IP.IsUnspecified() {
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(listenAddr.Port))
+	}
+	return listenAddr.String()
+}
+
+//IsClosed returns whether the listener is closed
+func (t *TCPTransport) IsClosed() bool {
+	t.closeLock.Lock()
+	defer t.closeLock.Unlock()
+	return t.closed
+}
+
+//Close stops listening for incoming connections
+func (t *TCPTransport) Close() error {
+	t.closeLock.Lock()
+	defer t.closeLock.Unlock()
+	t.closed = true
+	return t.listener.Close()
+}
+
+// The dialing side of the handshake
+//we send our nkn address and a challenge, the peer answers with its nkn address, a challenge and its signature over ours,
+//we answer with our listen address and our signature over its challenge
+func (t *TCPTransport) dialHandshake(conn net.Conn, peer string) error {
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := writeTCPFields(conn, []byte(t.identity), nonce); err != nil {
+		return err
+	}
+
+	fields, err := readTCPFields(conn, 3)
+	if err != nil {
+		return err
+	}
+	peerIdentity, peerNonce, peerSignature := string(fields[0]), fields[1], fields[2]
+	if peerIdentity != peer {
+		return errors.New("tcp peer is " + peerIdentity + ", dialed " + peer)
+	}
+	if err := verifyTCPSignature(peer, tcpSigningBytes("accept", nonce, t.identity, peer, ""), peerSignature); err != nil {
+		return err
+	}
+
+	localAddr := t.Addr()
+	signature := ed25519.Sign(t.privateKey, tcpSigningBytes("dial", peerNonce, peer, t.identity, localAddr))
+	return writeTCPFields(conn, []byte(localAddr), signature)
+}
+
+// The accepting side of the handshake, returns the nkn address of the peer
+func (t *TCPTransport) acceptHandshake(conn net.Conn) (string, error) {
+	fields, err := readTCPFields(conn, 2)
+	if err != nil {
+		return "", err
+	}
+	peer, peerNonce := string(fields[0]), fields[1]
+	if len(peer) == 0 || len(peerNonce) != tcpNonceSize {
+		return "", errors.New("invalid tcp handshake")
+	}
+
+	nonce := make([]byte, tcpNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	signature := ed25519.Sign(t.privateKey, tcpSigningBytes("accept", peerNonce, peer, t.identity, ""))
+	if err := writeTCPFields(conn, []byte(t.identity), nonce, signature); err != nil {
+		return "", err
+	}
+
+	fields, err = readTCPFields(conn, 2)
+	if err != nil {
+		return "", err
+	}
+	peerAddr, peerSignature := string(fields[0]), fields[1]
+	if err := verifyTCPSignature(peer, tcpSigningBytes("dial", nonce, t.identity, peer, peerAddr), peerSignature); err != nil {
+		return "", err
+	}
+
+	//The peer signed its listen address, so we can dial it back
+	if len(peerAddr) > 0 {
+		t.SetPeerAddress(peer, peerAddr)
+	}
+	return peer, nil
+}
+
+// returns the bytes a handshake signature covers, the challenge of the other side and both nkn addresses
+func tcpSigningBytes(step string, nonce []byte, to string, from string, listenAddr string) []byte {
+	var buff bytes.Buffer
+	buff.WriteString("surge tcp " + step)
+	for _, field := range [][]byte{nonce, []byte(to), []byte(from), []byte(listenAddr)} {
+		fieldSize := make([]byte, 2)
+		binary.LittleEndian.PutUint16(fieldSize, uint16(len(field)))
+		buff.Write(fieldSize)
+		buff.Write(field)
+	}
+	return buff.Bytes()
+}
+
+// checks a signature was made by the account owning the nkn address
+func verifyTCPSignature(peer string, message []byte, signature []byte) error {
+	publicKey, err := nkn.ClientAddrToPubKey(peer)
+	if err != nil {
+		return err
+	}
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, message, signature) {
+		return errors.New("tcp peer could not prove it owns " + peer)
+	}
+	return nil
+}
+
+// writes length prefixed fields
+func writeTCPFields(conn net.Conn, fields ...[]byte) error {
+	buff := []byte{}
+	for _, field := range fields {
+		fieldSize := make([]byte, 2)
+		binary.LittleEndian.PutUint16(fieldSize, uint16(len(field)))
+		buff = append(buff, fieldSize...)
+		buff = append(buff, field...)
+	}
+
+	_, err := conn.Write(buff)
+	return err
+}
+
+// reads the given number of length prefixed fields
+func readTCPFields(conn net.Conn, count int) ([][]byte, error) {
+	fields := make([][]byte, count)
+	for i := range fields {
+		sizeBuffer := make([]byte, 2)
+		if _, err := io.ReadFull(conn, sizeBuffer); err != nil {
+			return nil, err
+		}
+
+		fields[i] = make([]byte, binary.LittleEndian.Uint16(sizeBuffer))
+		if _, err := io.ReadFull(conn, fields[i]); err != nil {
+			return nil, err
+		}
+	}
+	return fields, nil
+}
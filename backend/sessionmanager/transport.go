@@ -0,0 +1,28 @@
+package sessionmanager
+
+import "net"
+
+// Transport carries surge sessions between peers, the nkn multiclient is the default implementation
+//peers are addressed by their nkn address on every transport
+type Transport interface {
+	//Dial opens an outgoing connection to the peer with the given address
+	Dial(address string) (net.Conn, error)
+
+	//Accept blocks until an incoming connection is received
+	Accept() (net.Conn, error)
+
+	//Handshake identifies the peer of an accepted connection, it runs per connection so a silent peer does not hold up accepting others
+	//the RemoteAddr of the returned connection has to be the address the peer is dialed on, sessions are keyed by it
+	Handshake(conn net.Conn) (net.Conn, error)
+
+	//Addr returns the address remote peers can dial us on
+	Addr() string
+
+	//IsClosed returns whether the transport stopped accepting connections
+	IsClosed() bool
+}
+
+// peerAddressBook is implemented by transports that dial peers on another address than their nkn address
+type peerAddressBook interface {
+	SetPeerAddress(peer string, address string)
+}
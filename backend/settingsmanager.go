@@ -1,10 +1,14 @@
 package surge
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
 	"strconv"
 
 	"github.com/rule110-io/surge/backend/constants"
 	"github.com/rule110-io/surge/backend/platform"
+	"github.com/rule110-io/surge/backend/sessionmanager"
 )
 
 //GetDownloadFolderPath uses the folder setting, or default donwload folder fallback.
@@ -48,3 +52,100 @@ func getNumberWorkers() int {
 		return constants.NumWorkers
 	}
 }
+
+func getNumberUploadSlots() int {
+	num, err := DbReadSetting("uploadSlots")
+	if err == nil && len(num) > 0 {
+		val, _ := strconv.Atoi(num)
+		return clamp(val, constants.UploadSlotsMin, constants.UploadSlotsMax)
+	}
+	return constants.UploadSlots
+}
+
+func getMaxActiveDownloads() int {
+	num, err := DbReadSetting("maxActiveDownloads")
+	if err == nil && len(num) > 0 {
+		val, _ := strconv.Atoi(num)
+		return clamp(val, constants.MaxActiveDownloadsMin, constants.MaxActiveDownloadsMax)
+	}
+	return constants.MaxActiveDownloads
+}
+
+func getDefaultChunkStrategy() string {
+	strategy, err := DbReadSetting("chunkStrategy")
+	if err == nil && IsValidChunkStrategy(strategy) {
+		return strategy
+	}
+	return constants.ChunkStrategyDefault
+}
+
+//createSessionTransport creates the session transport from settings, nkn unless configured otherwise
+func createSessionTransport() (sessionmanager.Transport, error) {
+	transportType, err := DbReadSetting("sessionTransport")
+	if err != nil || transportType != constants.SessionTransportTCP {
+		return sessionmanager.NewNKNTransport(client), nil
+	}
+
+	listenAddr, err := DbReadSetting("sessionTransportAddr")
+	if err != nil || len(listenAddr) == 0 {
+		listenAddr = constants.DefaultTCPTransportAddr
+	}
+	return sessionmanager.NewTCPTransport(listenAddr, client)
+}
+
+//IsAPIEnabled returns whether the local control api is enabled in settings
+func IsAPIEnabled() bool {
+	enabled, err := DbReadSetting("apiEnabled")
+	return err == nil && enabled == "true"
+}
+
+//GetAPIAddress returns the listen address of the local control api
+func GetAPIAddress() string {
+	addr, err := DbReadSetting("apiAddr")
+	if err == nil && len(addr) > 0 {
+		return addr
+	}
+	return constants.DefaultAPIAddr
+}
+
+//IsMetricsEnabled returns whether the metrics endpoint is enabled in settings
+func IsMetricsEnabled() bool {
+	enabled, err := DbReadSetting("metricsEnabled")
+	return err == nil && enabled == "true"
+}
+
+//GetMetricsAddress returns the listen address of the metrics endpoint
+func GetMetricsAddress() string {
+	addr, err := DbReadSetting("metricsAddr")
+	if err == nil && len(addr) > 0 {
+		return addr
+	}
+	return constants.DefaultMetricsAddr
+}
+
+//GetAPIToken returns the token for the local control api, a new one is generated on first use.
+//The token is also written to the surge dir so local tools like surge-cli can pick it up.
+func GetAPIToken() (string, error) {
+	token, err := DbReadSetting("apiToken")
+	if err != nil || len(token) == 0 {
+		b := make([]byte, 32)
+		_, err = rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		token = hex.EncodeToString(b)
+
+		err = DbWriteSetting("apiToken", token)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	tokenPath := platform.GetSurgeDir() + string(os.PathSeparator) + constants.APITokenFile
+	err = os.WriteFile(tokenPath, []byte(token), 0600)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
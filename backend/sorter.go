@@ -95,3 +95,26 @@ type sortByListingFileSizeDesc []models.FileListing
 func (a sortByListingFileSizeDesc) Len() int           { return len(a) }
 func (a sortByListingFileSizeDesc) Less(i, j int) bool { return a[i].FileSize > a[j].FileSize }
 func (a sortByListingFileSizeDesc) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+//Listings that match equally well are ordered by seeders
+type sortByListingRelevanceAsc []models.FileListing
+
+func (a sortByListingRelevanceAsc) Len() int { return len(a) }
+func (a sortByListingRelevanceAsc) Less(i, j int) bool {
+	if a[i].Relevance != a[j].Relevance {
+		return a[i].Relevance < a[j].Relevance
+	}
+	return a[i].NumSeeders < a[j].NumSeeders
+}
+func (a sortByListingRelevanceAsc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+
+type sortByListingRelevanceDesc []models.FileListing
+
+func (a sortByListingRelevanceDesc) Len() int { return len(a) }
+func (a sortByListingRelevanceDesc) Less(i, j int) bool {
+	if a[i].Relevance != a[j].Relevance {
+		return a[i].Relevance > a[j].Relevance
+	}
+	return a[i].NumSeeders > a[j].NumSeeders
+}
+func (a sortByListingRelevanceDesc) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
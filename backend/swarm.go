@@ -0,0 +1,123 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the swarming functions
+	Downloaders announce themselves as partial seeders and exchange chunk maps over their sessions,
+	so chunks are only requested from peers that actually have them.
+*/
+
+package surge
+
+import (
+	"log"
+	"time"
+
+	bitmap "github.com/boljen/go-bitmap"
+	"github.com/rule110-io/surge/backend/constants"
+	pb "github.com/rule110-io/surge/backend/payloads"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+	"google.golang.org/protobuf/proto"
+)
+
+// RequestChunkMap sends a request for the chunk map of a file
+func RequestChunkMap(Session *sessionmanager.Session, FileID string) bool {
+	msg := &pb.SurgeMessage{
+		FileID: FileID,
+	}
+	msgSerialized, err := proto.Marshal(msg)
+	if err != nil {
+		log.Println("Failed to encode chunk map request:", err)
+		return false
+	}
+
+	_, err = SessionWrite(Session, msgSerialized, constants.SurgeChunkMapID)
+	if err != nil {
+		log.Println("Failed to request chunk map", err)
+		return false
+	}
+	return true
+}
+
+// TransmitChunkMap sends our chunk map of a file, seeded files have all chunks
+func TransmitChunkMap(Session *sessionmanager.Session, FileID string) {
+	defer RecoverAndLog()
+
+	fileInfo, err := dbGetFile(FileID)
+	if err != nil {
+		return
+	}
+
+	chunkMap := fileInfo.ChunkMap
+	if fileInfo.IsUploading || chunkMap == nil {
+		chunkMap = bitmap.NewSlice(fileInfo.NumChunks)
+		for i := 0; i < fileInfo.NumChunks; i++ {
+			bitmap.Set(chunkMap, i, true)
+		}
+	}
+
+	dataReply := &pb.SurgeMessage{
+		FileID: FileID,
+		Data:   chunkMap,
+	}
+	dataReplySerialized, err := proto.Marshal(dataReply)
+	if err != nil {
+		log.Println("Error on transmit chunk map - serialization error", err.Error())
+		return
+	}
+
+	_, err = SessionWrite(Session, dataReplySerialized, constants.SurgeChunkMapID)
+	if err != nil {
+		log.Println("Error on transmit chunk map - failed to write to session", err.Error())
+	}
+}
+
+func processChunkMap(Session *sessionmanager.Session, Data []byte) {
+	surgeMessage := &pb.SurgeMessage{}
+	if err := proto.Unmarshal(Data, surgeMessage); err != nil {
+		log.Println("Failed to parse chunk map message:", err)
+		return
+	}
+
+	//Data nil means its a request for our chunk map
+	if surgeMessage.Data == nil {
+		TransmitChunkMap(Session, surgeMessage.FileID)
+		return
+	}
+
+	//Only track chunk maps of partial seeders, full seeders are assumed to have everything
+	addr := Session.Session.RemoteAddr().String()
+	if IsPartialSeeder(surgeMessage.FileID, addr) {
+		SetPartialSeeder(surgeMessage.FileID, addr, surgeMessage.Data)
+	}
+}
+
+// periodically requests chunk maps from the partial seeders of a download until the download terminates
+func refreshSeederChunkMaps(fileHash string, terminateFlag *bool) {
+	for !*terminateFlag {
+		for _, seeder := range GetPartialSeeders(fileHash) {
+			session, exists := sessionmanager.GetExistingSessionWithoutClosing(seeder, constants.WorkerGetSessionTimeout)
+			if !exists {
+				var err error
+				session, err = sessionmanager.GetSession(seeder)
+				if err != nil {
+					continue
+				}
+			}
+			RequestChunkMap(session, fileHash)
+		}
+
+		time.Sleep(time.Second * constants.ChunkMapRefreshInterval)
+	}
+}
+
+// returns whether any seeder of a file has the given chunk
+func anySeederHasChunk(fileHash string, chunkID int) bool {
+	for _, seeder := range GetSeeders(fileHash) {
+		if SeederHasChunk(fileHash, seeder, chunkID) {
+			return true
+		}
+	}
+	return false
+}
@@ -6,9 +6,9 @@ import (
 	"sort"
 
 	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
 	"github.com/rule110-io/surge/backend/models"
 	"github.com/rule110-io/surge/backend/mutexes"
-	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 var topicsMap map[string]models.Topic
@@ -134,14 +134,7 @@ func GetTopicInfo(topicName string) models.TopicInfo {
 	subCount, _ := client.GetSubscribersCount(topicEncoded)
 
 	//count files with topic
-	fileCount := 0
-	for _, v := range ListedFiles {
-		bitSetVar := 0
-		if v.Topic == topicName {
-			bitSetVar = 1
-		}
-		fileCount += bitSetVar
-	}
+	fileCount := ListedFiles.CountTopic(topicName)
 
 	state := 0
 
@@ -183,6 +176,18 @@ func GetTopicPermissions(topicName string, clientAddr string) models.TopicPermis
 	}
 }
 
+// returns the names of the topics we subscribe to
+func getSubscribedTopicNames() []string {
+	mutexes.TopicsMapLock.Lock()
+	defer mutexes.TopicsMapLock.Unlock()
+
+	topicNames := []string{}
+	for _, topic := range topicsMap {
+		topicNames = append(topicNames, topic.Name)
+	}
+	return topicNames
+}
+
 func GetTopicsWithPermissions() []models.TopicInfo {
 	topicNames := []string{}
 
@@ -223,8 +228,10 @@ func updateTopicSubscriptionState(TopicEncoded string, NewState int) {
 
 	if isChanged {
 		topicEncodedSubcribeStateMap[TopicEncoded] = NewState
-		if FrontendReady {
-			runtime.EventsEmit(*wailsContext, "topicsUpdated")
-		}
+		emitEvent(events.TopicsUpdated)
+		emitEvent(events.TopicStateChanged, events.TopicEvent{
+			Topic: TopicDecode(TopicEncoded),
+			State: NewState,
+		})
 	}
 }
@@ -0,0 +1,303 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	This file contains the upload scheduler
+	Incoming chunk requests are queued per peer and served round robin by a fixed number of upload slots.
+	Only as many peers as there are slots are unchoked at once, choked peers are answered busy so they download elsewhere.
+	Peers that do not know busy replies are held to the same queues, requests we do not serve them are dropped and requested again once they time out.
+	Every rechoke interval the longest unchoked peer makes room for the longest waiting one.
+*/
+
+package surge
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/sessionmanager"
+)
+
+//A chunk request waiting for an upload slot
+type uploadRequest struct {
+	Session *sessionmanager.Session
+	FileID  string
+	ChunkID int32
+}
+
+//Upload state of a peer
+type uploadPeer struct {
+	queue         []uploadRequest
+	active        int
+	unchoked      bool
+	unchokedSince time.Time
+	waitingSince  time.Time //when a choked peer first asked for a chunk, zero when it did not
+	legacy        bool      //the peer does not know busy replies
+}
+
+//UploadPeerStatus describes the upload state of a peer
+type UploadPeerStatus struct {
+	Addr    string
+	Queued  int
+	Active  int
+	Choked  bool
+	Waiting bool
+}
+
+//UploadStatus describes the upload slots and request queue
+type UploadStatus struct {
+	Slots       int
+	ActiveSlots int
+	QueueDepth  int
+	QueueSize   int
+	Peers       []UploadPeerStatus
+}
+
+var uploadPeers = map[string]*uploadPeer{}
+
+//order in which peers get a slot, rotated for round robin
+var uploadPeerOrder = []string{}
+var uploadActiveSlots = 0
+var uploadQueueDepth = 0
+var uploadLock = sync.Mutex{}
+var uploadCond = sync.NewCond(&uploadLock)
+
+// starts serving queued chunk requests and rotating unchoked peers
+func startUploadScheduler() {
+	go runUploadSlots()
+	go runRechoke()
+}
+
+// wakes the scheduler so a changed number of upload slots takes effect
+func applyUploadSlotSettings() {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	uploadCond.Signal()
+}
+
+// queues a chunk request, it is answered busy when the peer is choked or the queue is full, or dropped when the peer does not know busy replies
+func queueUpload(Session *sessionmanager.Session, FileID string, ChunkID int32) {
+	addr := Session.Session.RemoteAddr().String()
+	legacy := !peerSupports(addr, constants.FeatureChunkReplies)
+
+	uploadLock.Lock()
+	peer := getUploadPeer(addr)
+	peer.legacy = legacy
+
+	//Unchoke new peers while there is room
+	if !peer.unchoked && countUnchokedPeers() < getNumberUploadSlots() {
+		unchokePeer(peer)
+	}
+
+	accepted := peer.unchoked && uploadQueueDepth < constants.UploadQueueSize && len(peer.queue) < constants.UploadPeerQueueSize
+	if !peer.unchoked && peer.waitingSince.IsZero() {
+		peer.waitingSince = time.Now()
+	}
+	if accepted {
+		peer.queue = append(peer.queue, uploadRequest{
+			Session: Session,
+			FileID:  FileID,
+			ChunkID: ChunkID,
+		})
+		uploadQueueDepth++
+		addPendingTransmit(addr, FileID, ChunkID)
+		uploadCond.Signal()
+	}
+	uploadLock.Unlock()
+
+	if !accepted && !legacy {
+		SendChunkBusy(Session, FileID, ChunkID)
+	}
+}
+
+// serves queued requests round robin over peers while slots are free
+func runUploadSlots() {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	for {
+		for uploadQueueDepth <= 0 || uploadActiveSlots >= getNumberUploadSlots() {
+			uploadCond.Wait()
+		}
+
+		request, exists := nextUploadRequest()
+		if !exists {
+			//Nothing queued after all, resync the depth
+			uploadQueueDepth = 0
+			continue
+		}
+
+		addr := request.Session.Session.RemoteAddr().String()
+		peer := getUploadPeer(addr)
+		peer.queue = peer.queue[1:]
+		peer.active++
+		uploadQueueDepth--
+		uploadActiveSlots++
+
+		go func(request uploadRequest, addr string) {
+			TransmitChunk(request.Session, request.FileID, request.ChunkID)
+
+			uploadLock.Lock()
+			uploadActiveSlots--
+			if peer, exists := uploadPeers[addr]; exists {
+				peer.active--
+			}
+			uploadCond.Signal()
+			uploadLock.Unlock()
+		}(request, addr)
+	}
+}
+
+// returns the first queued request of the next peer in line and moves that peer to the back, call with uploadLock held
+func nextUploadRequest() (uploadRequest, bool) {
+	for i, addr := range uploadPeerOrder {
+		peer := uploadPeers[addr]
+		if len(peer.queue) == 0 {
+			continue
+		}
+
+		uploadPeerOrder = append(append(uploadPeerOrder[:i:i], uploadPeerOrder[i+1:]...), addr)
+		return peer.queue[0], true
+	}
+	return uploadRequest{}, false
+}
+
+// periodically chokes the longest unchoked peer in favour of the longest waiting one, and chokes idle peers
+func runRechoke() {
+	for {
+		time.Sleep(time.Second * constants.UploadRechokeInterval)
+
+		uploadLock.Lock()
+		var longestUnchoked, longestWaiting *uploadPeer
+		for _, peer := range uploadPeers {
+			if peer.unchoked {
+				//Idle peers give up their place
+				if len(peer.queue) == 0 && peer.active == 0 {
+					peer.unchoked = false
+					continue
+				}
+				if longestUnchoked == nil || peer.unchokedSince.Before(longestUnchoked.unchokedSince) {
+					longestUnchoked = peer
+				}
+			} else if !peer.waitingSince.IsZero() {
+				if longestWaiting == nil || peer.waitingSince.Before(longestWaiting.waitingSince) {
+					longestWaiting = peer
+				}
+			}
+		}
+
+		if longestWaiting != nil {
+			if countUnchokedPeers() >= getNumberUploadSlots() && longestUnchoked != nil {
+				chokePeer(longestUnchoked)
+			}
+			if countUnchokedPeers() < getNumberUploadSlots() {
+				unchokePeer(longestWaiting)
+			}
+		}
+		uploadCond.Signal()
+		uploadLock.Unlock()
+	}
+}
+
+// returns the upload state of a peer, call with uploadLock held
+func getUploadPeer(addr string) *uploadPeer {
+	peer, exists := uploadPeers[addr]
+	if !exists {
+		peer = &uploadPeer{}
+		uploadPeers[addr] = peer
+		uploadPeerOrder = append(uploadPeerOrder, addr)
+	}
+	return peer
+}
+
+// call with uploadLock held
+func countUnchokedPeers() int {
+	count := 0
+	for _, peer := range uploadPeers {
+		if peer.unchoked {
+			count++
+		}
+	}
+	return count
+}
+
+// call with uploadLock held
+func unchokePeer(peer *uploadPeer) {
+	peer.unchoked = true
+	peer.unchokedSince = time.Now()
+	peer.waitingSince = time.Time{}
+}
+
+// chokes a peer, its queued requests are answered busy so they are fetched elsewhere, call with uploadLock held
+// the requests of legacy peers are dropped, they time out on their side
+func chokePeer(peer *uploadPeer) {
+	peer.unchoked = false
+	for _, request := range peer.queue {
+		removePendingTransmit(request.Session.Session.RemoteAddr().String(), request.FileID, request.ChunkID)
+		if !peer.legacy {
+			go SendChunkBusy(request.Session, request.FileID, request.ChunkID)
+		}
+	}
+	uploadQueueDepth -= len(peer.queue)
+	peer.queue = nil
+}
+
+// drops the queued requests of a disconnected peer
+func removeUploadPeer(addr string) {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	peer, exists := uploadPeers[addr]
+	if !exists {
+		return
+	}
+	uploadQueueDepth -= len(peer.queue)
+	delete(uploadPeers, addr)
+	uploadPeerOrder = removeStringFromSlice(uploadPeerOrder, addr)
+}
+
+// removes a canceled request from the queue
+func removeQueuedUpload(addr string, FileID string, ChunkID int32) {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	peer, exists := uploadPeers[addr]
+	if !exists {
+		return
+	}
+	for i, request := range peer.queue {
+		if request.FileID == FileID && request.ChunkID == ChunkID {
+			peer.queue = append(peer.queue[:i], peer.queue[i+1:]...)
+			uploadQueueDepth--
+			return
+		}
+	}
+}
+
+//GetUploadStatus returns the upload slots, the request queue and the state of every peer
+func GetUploadStatus() UploadStatus {
+	uploadLock.Lock()
+	defer uploadLock.Unlock()
+
+	status := UploadStatus{
+		Slots:       getNumberUploadSlots(),
+		ActiveSlots: uploadActiveSlots,
+		QueueDepth:  uploadQueueDepth,
+		QueueSize:   constants.UploadQueueSize,
+		Peers:       []UploadPeerStatus{},
+	}
+	for _, addr := range uploadPeerOrder {
+		peer := uploadPeers[addr]
+		status.Peers = append(status.Peers, UploadPeerStatus{
+			Addr:    addr,
+			Queued:  len(peer.queue),
+			Active:  peer.active,
+			Choked:  !peer.unchoked,
+			Waiting: !peer.waitingSince.IsZero(),
+		})
+	}
+	return status
+}
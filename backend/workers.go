@@ -12,10 +12,11 @@ package surge
 import (
 	"time"
 
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/events"
 	"github.com/rule110-io/surge/backend/models"
 	"github.com/rule110-io/surge/backend/mutexes"
 	"github.com/rule110-io/surge/backend/platform"
-	"github.com/wailsapp/wails/v2/pkg/runtime"
 )
 
 // makes sure the client is regularly subscribed to the surge topic
@@ -28,6 +29,25 @@ func autoSubscribeWorker() {
 	}
 }
 
+// regularly announces our files again and expires remote listings that were not announced for too long
+func listingRefreshWorker() {
+	for {
+		time.Sleep(time.Second * constants.ListingAnnounceInterval)
+
+		mutexes.TopicsMapLock.Lock()
+		topics := []string{}
+		for _, topic := range topicsMap {
+			topics = append(topics, topic.NameEncoded)
+		}
+		mutexes.TopicsMapLock.Unlock()
+
+		for _, topicEncoded := range topics {
+			AnnounceRefreshFiles(topicEncoded)
+		}
+		expireListings()
+	}
+}
+
 // takes care that file data is regularly updated and stored in the database
 func updateFileDataWorker() {
 
@@ -60,13 +80,19 @@ func updateFileDataWorker() {
 				fileProgressMap[file.FileHash] = progress
 
 				if progress >= 1.0 {
-					file.IsDownloading = false
-					file.IsUploading = false
-					file.IsAvailable = false
-					file.IsHashing = true
-					dbInsertFile(file)
-
-					go VerifyFile(file)
+					//Reread under the lock so the write does not drop changes made since the file was listed
+					mutexes.FileWriteLock.Lock()
+					current, err := dbGetFile(file.FileHash)
+					if err == nil && current.IsDownloading {
+						current.IsDownloading = false
+						current.IsUploading = false
+						current.IsAvailable = false
+						current.IsHashing = true
+						dbInsertFile(*current)
+
+						go VerifyFile(*current)
+					}
+					mutexes.FileWriteLock.Unlock()
 				}
 			}
 
@@ -97,7 +123,7 @@ func updateFileDataWorker() {
 		mutexes.BandwidthAccumulatorMapLock.Unlock()
 
 		if !zeroBandwidthMap["total"] || totalDown+totalUp != 0 {
-			runtime.EventsEmit(*wailsContext, "globalBandwidthUpdate", statusBundle, totalDown, totalUp)
+			emitEvent(events.BandwidthUpdate, statusBundle, totalDown, totalUp)
 		}
 
 		zeroBandwidthMap["total"] = totalDown+totalUp == 0
@@ -109,28 +135,36 @@ func VerifyFile(file models.File) {
 
 	if err != nil {
 		pushError("Download Failed", "File hash could not be verified.")
-	} else {
-		if file.FileHash == fileHash {
-			file.IsDownloading = false
-			file.IsHashing = false
-			file.IsUploading = true
-			file.IsAvailable = true
-			dbInsertFile(file)
-
-			if err == nil {
-				AnnounceNewFile(&file)
-			}
-			platform.ShowNotification("Download Finished", "Download for "+file.FileName+" finished!")
-			pushNotification("Download Finished", file.FileName)
+		emitFileEvent(events.VerificationFailed, &file, err.Error())
+		return
+	}
 
+	//Hashing takes a while, update the stored file so chunks shared meanwhile are kept
+	mutexes.FileWriteLock.Lock()
+	if current, err := dbGetFile(file.FileHash); err == nil {
+		file = *current
+	}
+	isValid := file.FileHash == fileHash
+	file.IsDownloading = false
+	file.IsHashing = false
+	file.IsUploading = isValid
+	file.IsAvailable = isValid
+	file.IsMissing = !isValid
+	dbInsertFile(file)
+	mutexes.FileWriteLock.Unlock()
+
+	if isValid {
+		//Files of a bundle are listed as part of the bundle
+		if len(file.BundleHash) > 0 {
+			announceBundleIfComplete(file.BundleHash)
 		} else {
-			pushError("Download Failed", "File hash does not match local file.")
-			file.IsDownloading = false
-			file.IsHashing = false
-			file.IsUploading = false
-			file.IsAvailable = false
-			file.IsMissing = true
-			dbInsertFile(file)
+			AnnounceNewFile(&file)
 		}
+		platform.ShowNotification("Download Finished", "Download for "+file.FileName+" finished!")
+		pushNotification("Download Finished", file.FileName)
+		emitFileEvent(events.DownloadFinished, &file, "")
+	} else {
+		pushError("Download Failed", "File hash does not match local file.")
+		emitFileEvent(events.VerificationFailed, &file, "file hash does not match")
 	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/platform"
+)
+
+// apiClient calls methods on the control api of a running surge node
+type apiClient struct {
+	addr  string
+	token string
+	http  *http.Client
+}
+
+type callResponse struct {
+	Result json.RawMessage
+	Error  string
+}
+
+func newAPIClient(addr string, token string) (*apiClient, error) {
+	if len(token) == 0 {
+		//Fall back to the token the node wrote in our surge dir
+		tokenPath := platform.GetSurgeDir() + string(os.PathSeparator) + constants.APITokenFile
+		tokenBytes, err := os.ReadFile(tokenPath)
+		if err != nil {
+			return nil, errors.New("no api token found at " + tokenPath + ", is surge running with --headless or --api?")
+		}
+		token = strings.TrimSpace(string(tokenBytes))
+	}
+
+	return &apiClient{
+		addr:  addr,
+		token: token,
+		http: &http.Client{
+			Timeout: time.Second * 60,
+		},
+	}, nil
+}
+
+//call invokes a middleware method with positional arguments and returns the raw json result
+func (c *apiClient) call(method string, args ...interface{}) (json.RawMessage, error) {
+	if args == nil {
+		args = []interface{}{}
+	}
+	body, err := json.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+c.addr+"/api/"+method, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	response := callResponse{}
+	err = json.Unmarshal(resBody, &response)
+	if err != nil {
+		return nil, errors.New("invalid response from node: " + string(resBody))
+	}
+	if len(response.Error) > 0 {
+		return nil, errors.New(response.Error)
+	}
+
+	return response.Result, nil
+}
+
+//callInto invokes a middleware method and decodes the result into out
+func (c *apiClient) callInto(out interface{}, method string, args ...interface{}) (json.RawMessage, error) {
+	raw, err := c.call(method, args...)
+	if err != nil {
+		return nil, err
+	}
+	return raw, json.Unmarshal(raw, out)
+}
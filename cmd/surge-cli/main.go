@@ -0,0 +1,851 @@
+// Copyright 2021 rule101. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+	surge-cli is a command line client for a running surge node
+	It talks to the local control api served by surge --headless or surge --api
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rule110-io/surge/backend/constants"
+	"github.com/rule110-io/surge/backend/hookfile"
+	"github.com/rule110-io/surge/backend/models"
+)
+
+const usage = `usage: surge-cli [--json] [--addr host:port] [--token token] <command> [arguments]
+
+commands:
+  seed <path> --topic <topic>       seed a file, or a directory as a single bundle, in a topic
+  get <magnet>                      download the files of a magnet link
+  get <hash> --paths <p1,p2>        download some files of a bundle
+  files <hash>                      list the files of a bundle
+  export <hash> <path> [--description text]
+                                    write a signed .surge file describing a local file or bundle
+  import <path>                     download the file or bundle a .surge file describes
+  ls [query] [--filter state]       list local files, state is all, downloading, seeding, completed or paused
+  search [query] --topic <topic>    search remote files listed in a topic, --all-topics searches every subscribed topic
+         [--ext mkv,mp4] [--min-size 100M] [--max-size 2G] [--min-seeders n] [--sort relevance|name|size|seeders]
+         [--network [--wait seconds]]   also ask the peers of the topics for matching files and wait for their replies
+  info <hash>                       show details of a local file
+  peers <hash>                      show the seeders of a file
+  pause <hash>...                   pause downloads
+  resume <hash>...                  resume downloads
+  strategy <hash> <strategy>        set the chunk order of a download, sequential, random or rarest
+  limit [hash] --down <rate> --up <rate>
+                                    cap bandwidth of a file, or of all files without hash, e.g. 500k or 2M per second, 0 is unlimited
+  uploads                           show upload slots, the request queue and choked peers
+  queue                             show active and queued downloads
+  priority <hash> <priority>        set the queue priority of a download, high, normal or low
+  move <hash> <position>            move a queued download, 0 is next
+  rm <hash> [--from-disk]           remove a file from surge, optionally from disk too
+  topics [ls]                       list topic subscriptions
+  topics sub <topic>                subscribe to a topic
+  topics unsub <topic>              unsubscribe from a topic
+  hooks [ls]                        list event hooks
+  hooks add <event> <exec|webhook> <target>
+                                    run an executable or post to a webhook url on an event, edits the hooks file in the surge dir
+  hooks rm <id>                     remove a hook from the hooks file
+  hooks reload                      make the node read the hooks file again after editing it by hand
+  hooks log                         show recent hook executions
+  wallet balance                    show the wallet balance
+  wallet address                    show the wallet address
+`
+
+//mirrors surge.PagedQueryResult
+type pagedQueryResult struct {
+	Result []models.FileTransfer
+	Count  int
+}
+
+//mirrors surge.PagedQueryRemoteResult
+type pagedQueryRemoteResult struct {
+	Result []models.FileListing
+	Count  int
+}
+
+//mirrors surge.UploadPeerStatus
+type uploadPeerStatus struct {
+	Addr    string
+	Queued  int
+	Active  int
+	Choked  bool
+	Waiting bool
+}
+
+//mirrors surge.UploadStatus
+type uploadStatus struct {
+	Slots       int
+	ActiveSlots int
+	QueueDepth  int
+	QueueSize   int
+	Peers       []uploadPeerStatus
+}
+
+//mirrors surge.QueuedDownload
+type queuedDownload struct {
+	FileHash string
+	FileName string
+	Priority string
+	Position int
+	IsActive bool
+}
+
+//mirrors surge.SeederDetails
+type seederDetails struct {
+	PublicKey       string
+	Workers         int
+	ActiveSession   bool
+	LastActivity    int64
+	ProtocolVersion int
+	ClientVersion   string
+	Stats           seederStats
+}
+
+//mirrors surge.SeederStats
+type seederStats struct {
+	ChunksReceived int
+	BytesReceived  int64
+	RoundTripMs    int64
+	Throughput     int64
+	Timeouts       int
+	Errors         int
+	BackedOff      bool
+	Window         int
+}
+
+//mirrors surge.FileDetails
+type fileDetails struct {
+	FileID              string
+	Seeders             []seederDetails
+	NumChunks           int
+	ChunksDownloaded    int
+	ChunksShared        int
+	BytesDownloaded     int64
+	BytesUploaded       int64
+	DateTimeAdded       int64
+	ChunkStrategy       string
+	Priority            string
+	DownloadLimit       int64
+	UploadLimit         int64
+	GlobalDownloadLimit int64
+	GlobalUploadLimit   int64
+}
+
+var filterStates = map[string]int{
+	"all":         0,
+	"downloading": 1,
+	"seeding":     2,
+	"completed":   3,
+	"paused":      4,
+}
+
+var jsonOutput = false
+var apiAddr = constants.DefaultAPIAddr
+var apiToken = ""
+
+func main() {
+	global := flag.NewFlagSet("surge-cli", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addGlobalFlags(global)
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	command := global.Arg(0)
+	err := run(command, global.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func addGlobalFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&jsonOutput, "json", jsonOutput, "print raw json results")
+	fs.StringVar(&apiAddr, "addr", apiAddr, "address of the surge control api")
+	fs.StringVar(&apiToken, "token", apiToken, "control api token, read from the surge dir when empty")
+}
+
+// parses flags that may appear before, between or after positional arguments
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	positional := []string{}
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	return positional
+}
+
+func run(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	addGlobalFlags(fs)
+	topic := fs.String("topic", constants.SurgeOfficialTopic, "topic name")
+	filter := fs.String("filter", "all", "local file state filter")
+	fromDisk := fs.Bool("from-disk", false, "also remove the file from disk")
+	paths := fs.String("paths", "", "comma separated bundle paths to download")
+	down := fs.String("down", "0", "download cap in bytes per second")
+	up := fs.String("up", "0", "upload cap in bytes per second")
+	description := fs.String("description", "", "description of an exported file")
+	allTopics := fs.Bool("all-topics", false, "search every subscribed topic")
+	extensions := fs.String("ext", "", "comma separated file extensions to search for")
+	minSize := fs.String("min-size", "0", "smallest file size to search for")
+	maxSize := fs.String("max-size", "0", "largest file size to search for, 0 is unlimited")
+	minSeeders := fs.Int("min-seeders", 0, "least number of seeders to search for")
+	sortBy := fs.String("sort", "", "order of search results, relevance, name, size or seeders")
+	network := fs.Bool("network", false, "ask peers for matching files before searching")
+	wait := fs.Int("wait", 5, "seconds to wait for peers to reply to a network search")
+	positional := parseArgs(fs, args)
+
+	//Hooks run commands on the node, they are edited in the surge dir rather than over the api so only local users can add them
+	if command == "hooks" && len(positional) > 0 && (positional[0] == "add" || positional[0] == "rm") {
+		return editHooks(positional)
+	}
+
+	api, err := newAPIClient(apiAddr, apiToken)
+	if err != nil {
+		return err
+	}
+
+	requireArgs := func(n int) error {
+		if len(positional) < n {
+			return fmt.Errorf("%s expects %d argument(s), see surge-cli --help", command, n)
+		}
+		return nil
+	}
+
+	switch command {
+	case "seed":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		//The node resolves relative paths against its own working directory
+		path, err := filepath.Abs(positional[0])
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			return printCall(api, "SeedDirectoryPath", path, *topic)
+		}
+		return printCall(api, "SeedFilePath", path, *topic)
+
+	case "get":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		if len(*paths) > 0 {
+			return printCall(api, "DownloadBundle", positional[0], strings.Split(*paths, ","))
+		}
+		return printCall(api, "StartDownloadMagnetLinks", strings.Join(positional, " "))
+
+	case "export":
+		if err := requireArgs(2); err != nil {
+			return err
+		}
+		metadata := ""
+		if _, err := api.callInto(&metadata, "GetMetadata", positional[0], *description); err != nil {
+			return err
+		}
+		if len(metadata) == 0 {
+			return fmt.Errorf("GetMetadata failed, check the node log")
+		}
+		if err := os.WriteFile(positional[1], []byte(metadata), 0644); err != nil {
+			return err
+		}
+		if jsonOutput {
+			fmt.Println("true")
+		} else {
+			fmt.Println("ok")
+		}
+
+	case "import":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		metadata, err := os.ReadFile(positional[0])
+		if err != nil {
+			return err
+		}
+		return printCall(api, "ImportMetadataContents", string(metadata))
+
+	case "files":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		files := []models.BundleFile{}
+		raw, err := api.callInto(&files, "GetBundleManifest", positional[0])
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(raw)
+		}
+		printBundleFiles(files)
+
+	case "ls":
+		state, ok := filterStates[*filter]
+		if !ok {
+			return fmt.Errorf("unknown filter %s", *filter)
+		}
+		result := pagedQueryResult{}
+		raw, err := api.callInto(&result, "GetLocalFiles", strings.Join(positional, " "), state, "FileName", false, 0, 1<<30)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(raw)
+		}
+		printLocalFiles(result)
+
+	case "search":
+		query := strings.Join(positional, " ")
+		filter := models.ListingFilter{MinSeeders: *minSeeders}
+		if len(*extensions) > 0 {
+			filter.Extensions = strings.Split(*extensions, ",")
+		}
+		var err error
+		if filter.MinSize, err = parseRate(*minSize); err != nil {
+			return fmt.Errorf("invalid size %s", *minSize)
+		}
+		if filter.MaxSize, err = parseRate(*maxSize); err != nil {
+			return fmt.Errorf("invalid size %s", *maxSize)
+		}
+
+		//Best matches first when searching for something, most seeded first otherwise
+		orderBy := map[string]string{"relevance": "Relevance", "name": "FileName", "size": "FileSize", "seeders": "NumSeeders"}[*sortBy]
+		if len(*sortBy) == 0 {
+			orderBy = "NumSeeders"
+			if len(query) > 0 {
+				orderBy = "Relevance"
+			}
+		} else if len(orderBy) == 0 {
+			return fmt.Errorf("unknown sort %s", *sortBy)
+		}
+
+		searchTopic := *topic
+		if *allTopics {
+			searchTopic = ""
+		}
+
+		//Peers reply with their matches directly, they are listed once they arrive
+		if *network {
+			succeeded := false
+			if _, err := api.callInto(&succeeded, "SearchNetwork", searchTopic, query); err != nil {
+				return err
+			}
+			if !succeeded {
+				return fmt.Errorf("SearchNetwork failed, check the node log")
+			}
+			time.Sleep(time.Duration(*wait) * time.Second)
+		}
+
+		result := pagedQueryRemoteResult{}
+		raw, err := api.callInto(&result, "SearchRemoteFiles", searchTopic, query, filter, orderBy, orderBy != "FileName", 0, 1<<30)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(raw)
+		}
+		printRemoteFiles(result)
+
+	case "info", "peers":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		details := fileDetails{}
+		raw, err := api.callInto(&details, "GetFileDetails", positional[0])
+		if err != nil {
+			return err
+		}
+		if len(details.FileID) == 0 {
+			return fmt.Errorf("no local file with hash %s", positional[0])
+		}
+		if jsonOutput && command == "info" {
+			return printJSON(raw)
+		}
+		if jsonOutput {
+			seeders := struct{ Seeders json.RawMessage }{}
+			if err := json.Unmarshal(raw, &seeders); err != nil {
+				return err
+			}
+			return printJSON(seeders.Seeders)
+		}
+		if command == "info" {
+			printFileDetails(details)
+		} else {
+			printSeeders(details.Seeders)
+		}
+
+	case "pause", "resume":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		return printCall(api, "SetDownloadPause", positional, command == "pause")
+
+	case "strategy":
+		if err := requireArgs(2); err != nil {
+			return err
+		}
+		return printCall(api, "SetChunkStrategy", positional[0], positional[1])
+
+	case "limit":
+		downLimit, err := parseRate(*down)
+		if err != nil {
+			return err
+		}
+		upLimit, err := parseRate(*up)
+		if err != nil {
+			return err
+		}
+		if len(positional) == 0 {
+			return printCall(api, "SetGlobalRateLimits", downLimit, upLimit)
+		}
+		return printCall(api, "SetFileRateLimit", positional[0], downLimit, upLimit)
+
+	case "uploads":
+		status := uploadStatus{}
+		raw, err := api.callInto(&status, "GetUploadStatus")
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(raw)
+		}
+		printUploadStatus(status)
+
+	case "queue":
+		queue := []queuedDownload{}
+		raw, err := api.callInto(&queue, "GetDownloadQueue")
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(raw)
+		}
+		printDownloadQueue(queue)
+
+	case "priority":
+		if err := requireArgs(2); err != nil {
+			return err
+		}
+		return printCall(api, "SetDownloadPriority", positional[0], positional[1])
+
+	case "move":
+		if err := requireArgs(2); err != nil {
+			return err
+		}
+		position, err := strconv.Atoi(positional[1])
+		if err != nil {
+			return fmt.Errorf("invalid position %s", positional[1])
+		}
+		return printCall(api, "MoveQueuedDownload", positional[0], position)
+
+	case "rm":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		return printCall(api, "RemoveFile", positional[0], *fromDisk)
+
+	case "topics":
+		subcommand := "ls"
+		if len(positional) > 0 {
+			subcommand = positional[0]
+		}
+		switch subcommand {
+		case "ls":
+			topics := []models.TopicInfo{}
+			raw, err := api.callInto(&topics, "GetTopicSubscriptions")
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(raw)
+			}
+			printTopics(topics)
+		case "sub":
+			if err := requireArgs(2); err != nil {
+				return err
+			}
+			return printCall(api, "SubscribeToTopic", positional[1])
+		case "unsub":
+			if err := requireArgs(2); err != nil {
+				return err
+			}
+			return printCall(api, "UnsubscribeFromTopic", positional[1])
+		default:
+			return fmt.Errorf("unknown topics command %s", subcommand)
+		}
+
+	case "hooks":
+		subcommand := "ls"
+		if len(positional) > 0 {
+			subcommand = positional[0]
+		}
+		switch subcommand {
+		case "ls":
+			hooks := []models.Hook{}
+			raw, err := api.callInto(&hooks, "GetHooks")
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(raw)
+			}
+			printHooks(hooks)
+		case "log":
+			executions := []models.HookExecution{}
+			raw, err := api.callInto(&executions, "GetHookLog")
+			if err != nil {
+				return err
+			}
+			if jsonOutput {
+				return printJSON(raw)
+			}
+			printHookLog(executions)
+		case "reload":
+			return printCall(api, "ReloadHooks")
+		default:
+			return fmt.Errorf("unknown hooks command %s", subcommand)
+		}
+
+	case "wallet":
+		if err := requireArgs(1); err != nil {
+			return err
+		}
+		switch positional[0] {
+		case "balance":
+			return printCall(api, "GetWalletBalance")
+		case "address":
+			return printCall(api, "GetWalletAddress")
+		default:
+			return fmt.Errorf("unknown wallet command %s", positional[0])
+		}
+
+	default:
+		return fmt.Errorf("unknown command %s, see surge-cli --help", command)
+	}
+
+	return nil
+}
+
+// edits the hooks file and asks a running node to read it again
+func editHooks(positional []string) error {
+	switch positional[0] {
+	case "add":
+		if len(positional) < 4 {
+			return fmt.Errorf("hooks add expects <event> <exec|webhook> <target>, see surge-cli --help")
+		}
+		target := positional[3]
+		if positional[2] == constants.HookTypeExec {
+			absTarget, err := filepath.Abs(target)
+			if err != nil {
+				return err
+			}
+			target = absTarget
+		}
+		hook, err := hookfile.Add(positional[1], positional[2], target)
+		if err != nil {
+			return err
+		}
+		if jsonOutput {
+			raw, _ := json.Marshal(hook)
+			printJSON(raw)
+		} else {
+			fmt.Println(hook.ID)
+		}
+	case "rm":
+		if len(positional) < 2 {
+			return fmt.Errorf("hooks rm expects <id>, see surge-cli --help")
+		}
+		if err := hookfile.Remove(positional[1]); err != nil {
+			return err
+		}
+		if jsonOutput {
+			fmt.Println("true")
+		} else {
+			fmt.Println("ok")
+		}
+	}
+
+	//A node that is not running reads the file when it starts
+	api, err := newAPIClient(apiAddr, apiToken)
+	if err == nil {
+		_, err = api.call("ReloadHooks")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "hooks file updated, the node reads it when it starts:", err)
+	}
+	return nil
+}
+
+// calls a method and prints its result as is
+func printCall(api *apiClient, method string, args ...interface{}) error {
+	raw, err := api.call(method, args...)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(raw)
+	}
+
+	//Print plain values without json quoting
+	var value interface{}
+	json.Unmarshal(raw, &value)
+	switch v := value.(type) {
+	case nil:
+		fmt.Println("ok")
+	case string:
+		fmt.Println(v)
+	case bool:
+		if !v {
+			return fmt.Errorf("%s failed, check the node log", method)
+		}
+		fmt.Println("ok")
+	default:
+		fmt.Println(string(raw))
+	}
+	return nil
+}
+
+func printJSON(raw json.RawMessage) error {
+	out := bytes.Buffer{}
+	err := json.Indent(&out, raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func fileState(file models.FileTransfer) string {
+	switch {
+	case file.IsMissing:
+		return "missing"
+	case file.IsHashing:
+		return "hashing"
+	case file.IsPaused:
+		return "paused"
+	case file.IsDownloading:
+		return "downloading"
+	case file.IsUploading:
+		return "seeding"
+	}
+	return "idle"
+}
+
+func printLocalFiles(result pagedQueryResult) {
+	w := newTable()
+	fmt.Fprintln(w, "HASH\tNAME\tSIZE\tSTATE\tPROGRESS\tSEEDERS\tTOPIC")
+	for _, file := range result.Result {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f%%\t%d\t%s\n", file.FileHash, file.FileName, byteCountSI(file.FileSize), fileState(file), file.Progress*100, file.NumSeeders, file.Topic)
+	}
+	w.Flush()
+}
+
+func printRemoteFiles(result pagedQueryRemoteResult) {
+	w := newTable()
+	fmt.Fprintln(w, "HASH\tNAME\tSIZE\tSEEDERS\tTRACKED\tTYPE\tLAST SEEN")
+	for _, file := range result.Result {
+		listingType := "file"
+		if file.IsBundle {
+			listingType = "bundle"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\t%s\n", file.FileHash, file.FileName, byteCountSI(file.FileSize), file.NumSeeders, file.IsTracked, listingType, formatAge(file.LastSeen))
+	}
+	w.Flush()
+}
+
+// formats a unix time as the time passed since, e.g. 5m0s ago
+func formatAge(unix int64) string {
+	if unix == 0 {
+		return "-"
+	}
+	return time.Since(time.Unix(unix, 0)).Truncate(time.Second).String() + " ago"
+}
+
+func printBundleFiles(files []models.BundleFile) {
+	w := newTable()
+	fmt.Fprintln(w, "HASH\tPATH\tSIZE")
+	for _, file := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", file.FileHash, file.Path, byteCountSI(file.FileSize))
+	}
+	w.Flush()
+}
+
+func printFileDetails(details fileDetails) {
+	w := newTable()
+	fmt.Fprintf(w, "Hash\t%s\n", details.FileID)
+	fmt.Fprintf(w, "Added\t%s\n", time.Unix(details.DateTimeAdded, 0).Format(time.RFC3339))
+	fmt.Fprintf(w, "Chunks\t%d/%d\n", details.ChunksDownloaded, details.NumChunks)
+	fmt.Fprintf(w, "Chunks shared\t%d\n", details.ChunksShared)
+	fmt.Fprintf(w, "Chunk strategy\t%s\n", details.ChunkStrategy)
+	fmt.Fprintf(w, "Priority\t%s\n", details.Priority)
+	fmt.Fprintf(w, "Download limit\t%s (global %s)\n", formatRate(details.DownloadLimit), formatRate(details.GlobalDownloadLimit))
+	fmt.Fprintf(w, "Upload limit\t%s (global %s)\n", formatRate(details.UploadLimit), formatRate(details.GlobalUploadLimit))
+	fmt.Fprintf(w, "Downloaded\t%s\n", byteCountSI(details.BytesDownloaded))
+	fmt.Fprintf(w, "Uploaded\t%s\n", byteCountSI(details.BytesUploaded))
+	fmt.Fprintf(w, "Seeders\t%d\n", len(details.Seeders))
+	w.Flush()
+}
+
+func printSeeders(seeders []seederDetails) {
+	w := newTable()
+	fmt.Fprintln(w, "PUBLIC KEY\tWORKERS\tSESSION\tLAST ACTIVITY\tPROTOCOL\tCLIENT\tCHUNKS\tRTT\tSPEED\tWINDOW\tTIMEOUTS\tERRORS\tBACKED OFF")
+	for _, seeder := range seeders {
+		lastActivity := "-"
+		if seeder.LastActivity > 0 {
+			lastActivity = time.Unix(seeder.LastActivity, 0).Format(time.RFC3339)
+		}
+		clientVersion := seeder.ClientVersion
+		if len(clientVersion) == 0 {
+			clientVersion = "-"
+		}
+		stats := seeder.Stats
+		roundTrip, speed := "-", "-"
+		if stats.ChunksReceived > 0 {
+			roundTrip = fmt.Sprintf("%d ms", stats.RoundTripMs)
+			speed = byteCountSI(stats.Throughput) + "/s"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%t\t%s\t%d\t%s\t%d\t%s\t%s\t%d\t%d\t%d\t%t\n", seeder.PublicKey, seeder.Workers, seeder.ActiveSession, lastActivity, seeder.ProtocolVersion, clientVersion,
+			stats.ChunksReceived, roundTrip, speed, stats.Window, stats.Timeouts, stats.Errors, stats.BackedOff)
+	}
+	w.Flush()
+}
+
+func printUploadStatus(status uploadStatus) {
+	fmt.Printf("Slots %d/%d, queued %d/%d\n", status.ActiveSlots, status.Slots, status.QueueDepth, status.QueueSize)
+
+	w := newTable()
+	fmt.Fprintln(w, "PEER\tACTIVE\tQUEUED\tSTATE")
+	for _, peer := range status.Peers {
+		state := "unchoked"
+		if peer.Choked && peer.Waiting {
+			state = "choked, waiting"
+		} else if peer.Choked {
+			state = "choked"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", peer.Addr, peer.Active, peer.Queued, state)
+	}
+	w.Flush()
+}
+
+func printDownloadQueue(queue []queuedDownload) {
+	w := newTable()
+	fmt.Fprintln(w, "POSITION\tHASH\tNAME\tPRIORITY")
+	for _, download := range queue {
+		position := "active"
+		if !download.IsActive {
+			position = strconv.Itoa(download.Position)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", position, download.FileHash, download.FileName, download.Priority)
+	}
+	w.Flush()
+}
+
+func printTopics(topics []models.TopicInfo) {
+	stateNames := []string{"unsubscribed", "pending", "subscribed"}
+
+	w := newTable()
+	fmt.Fprintln(w, "TOPIC\tSTATE\tWRITE")
+	for _, topic := range topics {
+		state := strconv.Itoa(topic.SubscriptionState)
+		if topic.SubscriptionState >= 0 && topic.SubscriptionState < len(stateNames) {
+			state = stateNames[topic.SubscriptionState]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\n", topic.Name, state, topic.Permissions.CanWrite)
+	}
+	w.Flush()
+}
+
+func printHooks(hooks []models.Hook) {
+	w := newTable()
+	fmt.Fprintln(w, "ID\tEVENT\tTYPE\tTARGET")
+	for _, hook := range hooks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", hook.ID, hook.Event, hook.Type, hook.Target)
+	}
+	w.Flush()
+}
+
+func printHookLog(executions []models.HookExecution) {
+	w := newTable()
+	fmt.Fprintln(w, "TIME\tHOOK\tEVENT\tATTEMPT\tRESULT\tDURATION")
+	for _, execution := range executions {
+		result := "ok"
+		if !execution.Success {
+			result = execution.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%dms\n", formatAge(execution.Time), execution.HookID, execution.Event, execution.Attempt, result, execution.Duration)
+	}
+	w.Flush()
+}
+
+//byteCountSI converts filesize in bytes to human readable text
+// parses a rate in bytes per second with an optional k, M or G suffix
+func parseRate(rate string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(rate, "k"), strings.HasSuffix(rate, "K"):
+		multiplier = 1000
+	case strings.HasSuffix(rate, "M"):
+		multiplier = 1000 * 1000
+	case strings.HasSuffix(rate, "G"):
+		multiplier = 1000 * 1000 * 1000
+	}
+	if multiplier > 1 {
+		rate = rate[:len(rate)-1]
+	}
+
+	value, err := strconv.ParseFloat(rate, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid rate %s", rate)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return byteCountSI(rate) + "/s"
+}
+
+func byteCountSI(b int64) string {
+	const unit = 1000
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB",
+		float64(b)/float64(div), "kMGTPE"[exp])
+}
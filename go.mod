@@ -6,6 +6,7 @@ require (
 	github.com/boljen/go-bitmap v0.0.0-20151001105940-23cd2fb0ce7d
 	github.com/deckarep/gosx-notifier v0.0.0-20180201035817-e127226297fb
 	github.com/golang/protobuf v1.5.2
+	github.com/gorilla/websocket v1.4.1
 	github.com/mxmCherry/movavg v1.1.0
 	github.com/nknorg/nkn-sdk-go v1.3.5
 	github.com/nknorg/nkn/v2 v2.0.6
@@ -25,7 +26,6 @@ require (
 	github.com/bwmarrin/snowflake v0.3.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
 	github.com/google/uuid v1.1.2 // indirect
-	github.com/gorilla/websocket v1.4.1 // indirect
 	github.com/gotk3/gotk3 v0.4.0 // indirect
 	github.com/hashicorp/errwrap v1.0.0 // indirect
 	github.com/hashicorp/go-multierror v1.0.0 // indirect
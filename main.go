@@ -3,11 +3,14 @@ package main
 import (
 	"embed"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"log"
 
 	surge "github.com/rule110-io/surge/backend"
+	"github.com/rule110-io/surge/backend/api"
 	"github.com/rule110-io/surge/backend/constants"
 	"github.com/rule110-io/surge/backend/platform"
 	"github.com/wailsapp/wails/v2"
@@ -39,11 +42,30 @@ func main() {
 
 	//stats := &Stats{}
 
-	argsWithoutProg := os.Args[1:]
+	//run without the wails window when invoked with --headless, serve the control api with --api and the metrics with --metrics
+	headless := false
+	serveAPI := false
+	serveMetrics := false
+	argsWithoutProg := []string{}
+	for _, arg := range os.Args[1:] {
+		if arg == "--headless" {
+			headless = true
+			continue
+		}
+		if arg == "--api" {
+			serveAPI = true
+			continue
+		}
+		if arg == "--metrics" {
+			serveMetrics = true
+			continue
+		}
+		argsWithoutProg = append(argsWithoutProg, arg)
+	}
 
 	//invoked with a download
 	if len(argsWithoutProg) > 0 {
-		arguments = os.Args[1:]
+		arguments = argsWithoutProg
 	}
 
 	//Initialize folder structures on os filesystem
@@ -70,9 +92,31 @@ func main() {
 		surge.DbWriteSetting("numWorkers", strconv.Itoa(constants.NumWorkers))
 	}
 
+	if headless {
+		surge.InitializeHeadless()
+	}
+
+	if headless || serveAPI || surge.IsAPIEnabled() {
+		startAPI()
+	}
+
+	if serveMetrics || surge.IsMetricsEnabled() {
+		startMetrics()
+	}
+
 	log.Println("-= starting surge client =-")
 	surge.StartClient(arguments)
 
+	if headless {
+		//keep running until we are asked to stop
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		surge.StopClient()
+		return
+	}
+
 	app := NewApp()
 
 	wails.Run(&options.App{
@@ -119,3 +163,34 @@ func main() {
 	})
 
 }
+
+// serves the middleware functions and backend events on the local control api
+func startAPI() {
+	token, err := surge.GetAPIToken()
+	if err != nil {
+		log.Println("Control api not started, failed to create token:", err)
+		return
+	}
+
+	server := api.NewServer(token, &surge.MiddlewareFunctions{}, surge.APIMethods)
+	surge.SubscribeEvents(server.Emit)
+
+	serve := func() {
+		err := server.ListenAndServe(surge.GetAPIAddress())
+		if err != nil {
+			log.Println("Control api stopped:", err)
+		}
+	}
+	go serve()
+}
+
+// serves the node metrics for prometheus
+func startMetrics() {
+	serve := func() {
+		err := surge.StartMetrics(surge.GetMetricsAddress())
+		if err != nil {
+			log.Println("Metrics stopped:", err)
+		}
+	}
+	go serve()
+}